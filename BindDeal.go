@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// 按网卡绑定套接字：只设置 LocalAddr 时，Linux 在没有源地址策略路由的情况下仍按主路由表选出口，
+// 第二张网卡的流量会从默认网关出去，"聚合"实际上只用了一条链路
+// NetCardConfig.json 中 BindDevice 为 true 时，拨号使用 SO_BINDTODEVICE 绑定到网卡（仅Linux）
+// 另提供 routing 子命令检查/安装每张网卡的 ip rule 与独立路由表，并诊断多张网卡是否走了同一出口
+
+// BindControl 网卡需要绑定时返回 net.Dialer.Control，否则返回nil
+// 网卡名在创建时解析一次
+func BindControl(LocalIP string) func(network string, address string, c syscall.RawConn) error {
+	if !GloNetCardConfig.CheckCard(LocalIP).BindDevice {
+		return nil
+	}
+	name := interfaceNameFor(LocalIP)
+	if name == "" {
+		fmt.Printf("⚠️ 找不到地址 %s 所在的网卡，无法绑定\n", LocalIP)
+		return nil
+	}
+	return bindToDevice(name)
+}
+
+// interfaceNameFor 查找地址所在的网卡名
+func interfaceNameFor(LocalIP string) string {
+	target := net.ParseIP(LocalIP)
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(target) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// RoutingCLI 处理 routing 子命令：
+//
+//	routing check    检查每张网卡的策略路由，并诊断出口是否重复
+//	routing install  缺少时安装 ip rule 与独立路由表（需要root）
+func RoutingCLI(args []string) {
+	action := "check"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "check":
+		if err := RoutingCheck(false); err != nil {
+			fmt.Printf("检查失败: %v\n", err)
+		}
+	case "install":
+		if err := RoutingCheck(true); err != nil {
+			fmt.Printf("安装失败: %v\n", err)
+		}
+	default:
+		fmt.Println("用法: routing [check|install]")
+	}
+}
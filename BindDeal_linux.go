@@ -0,0 +1,255 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	RouteTableBase    = 100  // 网卡独立路由表编号起点
+	RouteRulePriority = 1000 // ip rule 优先级起点，需小于 main 表的 32766
+	EgressProbeIP     = "1.1.1.1"
+	EgressProbeIPv6   = "2606:4700:4700::1111"
+)
+
+// bindToDevice 通过 SO_BINDTODEVICE 将套接字绑定到网卡（内核5.7之前需要 CAP_NET_RAW）
+func bindToDevice(name string) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("SO_BINDTODEVICE %s: %w", name, sockErr)
+		}
+		return nil
+	}
+}
+
+// nicRoute 一张网卡的策略路由信息
+type nicRoute struct {
+	IP      string
+	Name    string
+	Gateway string
+	Family  string // "-4" / "-6"
+	Table   int
+}
+
+// prefix 单个地址的前缀写法
+func (r nicRoute) prefix() string {
+	if r.Family == "-6" {
+		return r.IP + "/128"
+	}
+	return r.IP + "/32"
+}
+
+// nicRoutes 当前网卡按网卡名排序，依次分配路由表编号；同一网卡的v4/v6共用一个编号
+func nicRoutes() []nicRoute {
+	gateways := defaultGateways()
+	var routes []nicRoute
+	for IP, Info := range scanNetCards() {
+		route := nicRoute{IP: IP, Name: Info.Name, Gateway: gateways[Info.Name], Family: "-4"}
+		if !isIPv4(IP) {
+			route.Family = "-6"
+			route.Gateway = defaultGateway6(Info.Name)
+		}
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Name != routes[j].Name {
+			return routes[i].Name < routes[j].Name
+		}
+		return routes[i].Family < routes[j].Family
+	})
+	table := RouteTableBase - 1
+	for i := range routes {
+		if i == 0 || routes[i].Name != routes[i-1].Name {
+			table++
+		}
+		routes[i].Table = table
+	}
+	return routes
+}
+
+// defaultGateway6 网卡的IPv6默认网关（通常是路由器的链路本地地址）
+func defaultGateway6(name string) string {
+	out, err := runIP("-6", "route", "show", "default", "dev", name)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(out)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "via" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// defaultGateways 从 /proc/net/route 读取各网卡的默认网关
+func defaultGateways() map[string]string {
+	gateways := make(map[string]string)
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return gateways
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // 表头
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		gw := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(gw, binary.BigEndian.Uint32(raw))
+		if !gw.IsUnspecified() {
+			if _, ok := gateways[fields[0]]; !ok {
+				gateways[fields[0]] = gw.String()
+			}
+		}
+	}
+	return gateways
+}
+
+// gatewayMACSupported 能否读取网关MAC，不支持时方案不能按网关MAC匹配
+const gatewayMACSupported = true
+
+// gatewayMAC 从 /proc/net/arp 读取网卡默认网关的MAC
+func gatewayMAC(name string) string {
+	gw := defaultGateways()[name]
+	if gw == "" {
+		return ""
+	}
+	data, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		// IP address  HW type  Flags  HW address  Mask  Device
+		fields := strings.Fields(line)
+		if len(fields) >= 6 && fields[0] == gw && fields[5] == name && fields[3] != "00:00:00:00:00:00" {
+			return fields[3]
+		}
+	}
+	return ""
+}
+
+func runIP(args ...string) (string, error) {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// ruleTable 查找已有的 "from <IP> lookup <表>" 规则
+func ruleTable(rules string, IP string) (string, bool) {
+	for _, line := range strings.Split(rules, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "from" && (fields[i+1] == IP || fields[i+1] == IP+"/32" || fields[i+1] == IP+"/128") {
+				for j := i + 2; j+1 < len(fields); j++ {
+					if fields[j] == "lookup" || fields[j] == "table" {
+						return fields[j+1], true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// RoutingCheck 检查每张网卡是否有源地址策略路由，install 为 true 时补齐缺少的规则与路由
+func RoutingCheck(install bool) error {
+	rules := make(map[string]string)
+	for _, family := range []string{"-4", "-6"} {
+		out, err := runIP(family, "rule", "show")
+		if err != nil {
+			return err
+		}
+		rules[family] = out
+	}
+	for i, route := range nicRoutes() {
+		table, hasRule := ruleTable(rules[route.Family], route.IP)
+		if !hasRule {
+			table = fmt.Sprint(route.Table)
+		}
+		tableRoutes, _ := runIP(route.Family, "route", "show", "table", table)
+		hasDefault := strings.Contains(tableRoutes, "default")
+		fmt.Printf("网卡 %s (%s) 网关 %q: ip rule %v, 路由表 %s 默认路由 %v\n", route.Name, route.IP, route.Gateway, hasRule, table, hasDefault)
+		if !install || (hasRule && hasDefault) {
+			continue
+		}
+		if !hasDefault {
+			args := []string{route.Family, "route", "replace", "default"}
+			if route.Gateway != "" {
+				args = append(args, "via", route.Gateway)
+			}
+			args = append(args, "dev", route.Name, "table", table)
+			if _, err := runIP(args...); err != nil {
+				return err
+			}
+		}
+		if !hasRule {
+			if _, err := runIP(route.Family, "rule", "add", "from", route.prefix(), "table", table, "priority", fmt.Sprint(RouteRulePriority+i)); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("  已安装: from %s -> table %s\n", route.IP, table)
+	}
+	DiagnoseEgress()
+	return nil
+}
+
+// DiagnoseEgress 按源地址查询内核实际选择的出口，多张网卡走同一出口时给出警告（按地址族分别比较）
+func DiagnoseEgress() {
+	byDev := make(map[string][]string)
+	for IP, Info := range scanNetCards() {
+		target := EgressProbeIP
+		if !isIPv4(IP) {
+			target = EgressProbeIPv6
+		}
+		out, err := runIP("-o", "route", "get", target, "from", IP)
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(out)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "dev" {
+				if fields[i+1] != Info.Name && !GloNetCardConfig.CheckCard(IP).BindDevice {
+					fmt.Printf("⚠️ 网卡 %s (%s) 的流量实际从 %s 发出，请执行 routing install 或开启 BindDevice\n", Info.Name, IP, fields[i+1])
+				}
+				key := fields[i+1]
+				if !isIPv4(IP) {
+					key += " (IPv6)"
+				}
+				byDev[key] = append(byDev[key], IP)
+				break
+			}
+		}
+	}
+	for dev, IPs := range byDev {
+		if len(IPs) > 1 {
+			sort.Strings(IPs)
+			fmt.Printf("⚠️ 地址 %s 都从 %s 发出，聚合实际只使用了一条链路\n", strings.Join(IPs, ", "), dev)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+var bindDeviceWarn sync.Once
+
+// bindToDevice 只有Linux支持 SO_BINDTODEVICE，其他系统依靠 LocalAddr；只提示一次
+func bindToDevice(name string) func(network string, address string, c syscall.RawConn) error {
+	bindDeviceWarn.Do(func() {
+		fmt.Printf("⚠️ 当前系统不支持按网卡绑定 (%s)，仅使用源地址\n", name)
+	})
+	return nil
+}
+
+// RoutingCheck 策略路由检查只适用于Linux
+func RoutingCheck(install bool) error {
+	return fmt.Errorf("routing helper only supports linux")
+}
+
+// DiagnoseEgress 其他系统不做出口诊断
+func DiagnoseEgress() {}
@@ -23,6 +23,20 @@ type PolicyConfig struct {
 	ActionAcc []string `json:"ActionAccelerate"`
 	ActionPas []string `json:"ActionPassThrough"`
 	ActionIso []string `json:"ActionIso"`
+	// Rules 按Host配置的附加规则，"*" 为默认规则
+	Rules map[string]HostRule `json:"Rules"`
+}
+
+// HostRule 针对单个Host的附加规则
+type HostRule struct {
+	SidecarChecksum bool     `json:"SidecarChecksum"` // 分块加速时额外获取同目录下的 .sha256/.md5 校验文件
+	Mirrors         []string `json:"Mirrors"`         // 镜像基础地址，拼上原始请求路径后作为分块的备选来源
+	ResolveTo       []string `json:"ResolveTo"`       // 固定解析到这些地址，不再查询DNS
+	DNS             []string `json:"DNS"`             // 该Host使用的DNS服务器（仍经各网卡发出），覆盖网卡配置
+	DoH             string   `json:"DoH"`             // 该Host使用的DoH地址，覆盖网卡配置
+	Scheduler       string   `json:"Scheduler"`       // 分块调度器：ewma（默认）/ wrr / lob / thompson
+
+	Schedule []HostScheduleRule `json:"Schedule"` // 分时规则：按时段开关分块加速、调整各网卡权重
 }
 
 type HostPolicy struct {
@@ -31,14 +45,33 @@ type HostPolicy struct {
 }
 type PolicyManager struct {
 	mu       sync.RWMutex // 允许多读但是只能单写入
+	FilePath string
 	policies map[string]HostPolicy
+	rules    map[string]HostRule
 }
 
+const PolicyFilePath = "./HostPolicy.json"
+
 var GlobalPolicyManager = &PolicyManager{
+	FilePath: PolicyFilePath,
 	policies: make(map[string]HostPolicy),
+	rules:    make(map[string]HostRule),
 }
 
+// CheckPolicy 获取Host的策略，Host分时规则中设置了 Accelerate 时按当前时段覆盖
 func (p *PolicyManager) CheckPolicy(host string) HostPolicy {
+	policy := p.checkPolicy(host)
+	if rule, ok := p.HostSchedule(host, time.Now()); ok && rule.Accelerate != nil && policy.Action != ActionIsolate {
+		if *rule.Accelerate {
+			policy.Action = ActionAccelerate
+		} else {
+			policy.Action = ActionPassThrough
+		}
+	}
+	return policy
+}
+
+func (p *PolicyManager) checkPolicy(host string) HostPolicy {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
@@ -56,9 +89,21 @@ func (p *PolicyManager) CheckPolicy(host string) HostPolicy {
 	return HostPolicy{Action: ActionAccelerate}
 }
 
-// LoadPolicies 初始加载Json文件
+// CheckRule 获取Host的附加规则：精确匹配优先，其次 "*"，都没有时返回零值
+func (p *PolicyManager) CheckRule(host string) HostRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if rule, ok := p.rules[host]; ok {
+		return rule
+	}
+	return p.rules["*"]
+}
+
+// LoadPolicies 加载Json文件，切换配置方案时重新加载会整体替换原有策略
 func (p *PolicyManager) LoadPolicies() error {
-	filePath := "./HostPolicy.json"
+	p.mu.RLock()
+	filePath := p.FilePath
+	p.mu.RUnlock()
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return err
@@ -68,17 +113,31 @@ func (p *PolicyManager) LoadPolicies() error {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return fmt.Errorf("wrong Explanation: %s\n", err)
 	}
+	for host, rule := range config.Rules {
+		for _, s := range rule.Schedule {
+			if err := s.Validate(); err != nil {
+				return fmt.Errorf("rule %s schedule: %w", host, err)
+			}
+		}
+	}
 
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	policies := make(map[string]HostPolicy)
+	rules := make(map[string]HostRule)
 	for _, host := range config.ActionAcc {
-		p.policies[host] = HostPolicy{Action: ActionAccelerate}
+		policies[host] = HostPolicy{Action: ActionAccelerate}
 	}
 	for _, host := range config.ActionPas {
-		p.policies[host] = HostPolicy{Action: ActionPassThrough}
+		policies[host] = HostPolicy{Action: ActionPassThrough}
+	}
+	for host, rule := range config.Rules {
+		rules[host] = rule
 	}
-	// p.policies["download.test.com"] = HostPolicy{Action: ActionAccelerate}
-	p.policies["*"] = HostPolicy{Action: ActionAccelerate} // 默认流量直接转发
+	// policies["download.test.com"] = HostPolicy{Action: ActionAccelerate}
+	policies["*"] = HostPolicy{Action: ActionAccelerate} // 默认流量直接转发
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policies = policies
+	p.rules = rules
 	println("Load Done Policy...")
 	return nil
 }
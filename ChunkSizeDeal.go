@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// 自适应分块大小：启动测速只给出初始值，之后按每个分块实际的 RTT、首字节时间(TTFB)与吞吐持续调整，
+// 目标是每个分块大约耗时 TargetChunkTime，结果写回 BestChunkSizeRecorder，新规划的分块立即使用
+
+const (
+	TargetChunkTime = 2 * time.Second
+	MinChunkSize    = 512 * 1024
+	MaxChunkSize    = 64 * 1024 * 1024
+	ChunkSizeAlign  = 64 * 1024
+	ChunkSizeAlpha  = 0.3 // 样本的EWMA系数
+	TTFBShareLimit  = 0.2 // 首字节等待在单个分块耗时中的占比上限
+	RTTMultiple     = 16  // 分块至少为若干个带宽时延积，让拥塞窗口有时间增长
+)
+
+// chunkSizeStat 单张网卡的观测值（均为EWMA）
+type chunkSizeStat struct {
+	rate float64 // 单条连接的传输速率 B/s（不含首字节等待）
+	ttfb float64 // 秒
+	rtt  float64 // 秒，仅在新建连接时能测到
+}
+
+type ChunkSizer struct {
+	mu    sync.Mutex
+	stats map[string]*chunkSizeStat
+}
+
+var GloChunkSizer = &ChunkSizer{
+	stats: make(map[string]*chunkSizeStat),
+}
+
+func ewma(old float64, sample float64) float64 {
+	if old == 0 {
+		return sample
+	}
+	return ChunkSizeAlpha*sample + (1-ChunkSizeAlpha)*old
+}
+
+// Observe 记录一个完成的分块并重新计算该网卡的分块大小
+func (c *ChunkSizer) Observe(IP string, n int64, ttfb time.Duration, body time.Duration, rtt time.Duration) {
+	if n <= 0 || body <= 0 {
+		return
+	}
+	c.mu.Lock()
+	stat, ok := c.stats[IP]
+	if !ok {
+		stat = &chunkSizeStat{}
+		c.stats[IP] = stat
+	}
+	stat.rate = ewma(stat.rate, float64(n)/body.Seconds())
+	stat.ttfb = ewma(stat.ttfb, ttfb.Seconds())
+	if rtt > 0 {
+		stat.rtt = ewma(stat.rtt, rtt.Seconds())
+	}
+	size := stat.size()
+	c.mu.Unlock()
+
+	BestChunkSizeRecorder.mu.Lock()
+	old := BestChunkSizeRecorder.content[IP]
+	BestChunkSizeRecorder.content[IP] = size
+	BestChunkSizeRecorder.mu.Unlock()
+	if old > 0 && (size > old*2 || size < old/2) {
+		fmt.Printf("📐 %s 分块大小调整: %.1fMB -> %.1fMB\n", IP, float64(old)/(1024*1024), float64(size)/(1024*1024))
+	}
+}
+
+// Forget 网卡被移除时清除观测值
+func (c *ChunkSizer) Forget(IP string) {
+	c.mu.Lock()
+	delete(c.stats, IP)
+	c.mu.Unlock()
+}
+
+// size 单个分块耗时 = TTFB + 大小/速率，取满足目标耗时的大小；
+// 同时保证TTFB占比不超过上限、至少为若干个带宽时延积，最后限制在上下界内
+func (s *chunkSizeStat) size() int64 {
+	target := TargetChunkTime.Seconds()
+	size := s.rate * max(target-s.ttfb, 0)
+	size = max(size, s.rate*s.ttfb*(1-TTFBShareLimit)/TTFBShareLimit)
+	size = max(size, s.rate*s.rtt*RTTMultiple)
+	aligned := int64(size) / ChunkSizeAlign * ChunkSizeAlign
+	return min(max(aligned, MinChunkSize), MaxChunkSize)
+}
+
+// traceTiming 记录新建TCP连接的握手耗时（约一个RTT），连接复用时返回0
+func traceTiming(ctx context.Context) (context.Context, func() time.Duration) {
+	var mu sync.Mutex
+	var connectStart time.Time
+	var rtt time.Duration
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			if err == nil && !connectStart.IsZero() {
+				rtt = time.Since(connectStart)
+			}
+			mu.Unlock()
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return rtt
+	}
+}
@@ -21,11 +21,14 @@ const (
 
 var ContinueOnClientClose = false
 
+// ErrClientGone 客户端断开或写回失败，此时不再进行任何降级
+var ErrClientGone = errors.New("client DisConnected")
+
 // ========== 1. Reader/Writer结构/函数 ==========
 
 type MonitorWriterChunks struct {
 	ctx     context.Context
-	Writer  *bufio.ReadWriter
+	Writer  io.Writer
 	Monitor *ClientBytesRecorder
 	LocalIP string
 	Index   int
@@ -38,16 +41,84 @@ func (m *MonitorWriterChunks) Write(p []byte) (n int, err error) {
 	default:
 	}
 	n, err = m.Writer.Write(p)
-	if m.Index == 0 {
-		counters := m.Monitor.GetOrCreate(m.LocalIP)
-		counters.clientChunks0Bytes.Add(int64(n))
-	} else if m.Index == 1 {
-		counters := m.Monitor.GetOrCreate(m.LocalIP)
-		counters.clientChunks1Bytes.Add(int64(n))
-	}
+	m.Monitor.GetOrCreate(m.LocalIP).AddChunk(m.Index, n)
 	return n, err
 }
 
+// ClientStream 统一对客户端的写出（Content-Length定长），并记录已经交付给客户端的字节数，便于降级时从断点继续
+// 设置了 verifier 时对交付的字节流做哈希，并扣留末尾 HoldBackSize 字节，校验通过后才释放
+type ClientStream struct {
+	mu        sync.Mutex
+	bufrw     *bufio.ReadWriter
+	delivered int64 // 已接收的字节数（包括扣留部分）
+	total     int64
+	verifier  *IntegrityChecker
+	held      []byte
+	origin    string // 校验失败时记录的URL
+}
+
+func NewClientStream(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) *ClientStream {
+	s := &ClientStream{bufrw: bufrw, total: bag.AllBytes, origin: bag.OriginURL()}
+	var sidecar <-chan []ExpectedDigest
+	if GlobalPolicyManager.CheckRule(r.Host).SidecarChecksum {
+		sidecar = FetchSidecar(r.Context(), s.origin, r.Header)
+	}
+	s.verifier = NewIntegrityChecker(bag, sidecar)
+	return s
+}
+
+func (s *ClientStream) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := p
+	if s.verifier != nil {
+		s.verifier.Write(p)
+		// 超过释放上限的部分先扣留
+		releaseLimit := s.total - HoldBackSize
+		if cut := releaseLimit - s.delivered; cut < int64(len(p)) {
+			if cut < 0 {
+				cut = 0
+			}
+			out = p[:cut]
+			s.held = append(s.held, p[cut:]...)
+		}
+	}
+	n, err = s.bufrw.Write(out)
+	s.delivered += int64(n + len(p) - len(out))
+	if err != nil {
+		return n, err
+	}
+	return len(p), s.bufrw.Flush()
+}
+
+// Delivered 已经接收的字节数（扣留部分在校验通过后一定会交付）
+func (s *ClientStream) Delivered() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delivered
+}
+
+// Finish 校验摘要并释放扣留的末尾数据；校验失败时不释放，调用方关闭连接让客户端丢弃该文件
+func (s *ClientStream) Finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.verifier != nil {
+		if err := s.verifier.Verify(); err != nil {
+			fmt.Printf("❌ 完整性校验失败，中止连接: %v\n", err)
+			RecordIntegrityFailure(s.origin, err)
+			return err
+		}
+		if _, err := s.bufrw.Write(s.held); err != nil {
+			return err
+		}
+		s.held = nil
+	}
+	return s.bufrw.Flush()
+}
+
 type MonitorReaderChunks struct {
 	ctx     context.Context
 	Reader  io.Reader
@@ -63,13 +134,7 @@ func (m *MonitorReaderChunks) Read(p []byte) (n int, err error) {
 	default:
 	}
 	n, err = m.Reader.Read(p)
-	if m.Index == 0 {
-		counters := m.Monitor.GetOrCreate(m.LocalIP)
-		counters.clientChunks0Bytes.Add(int64(n))
-	} else if m.Index == 1 {
-		counters := m.Monitor.GetOrCreate(m.LocalIP)
-		counters.clientChunks1Bytes.Add(int64(n))
-	}
+	m.Monitor.GetOrCreate(m.LocalIP).AddChunk(m.Index, n)
 	return n, err
 }
 
@@ -82,6 +147,7 @@ type ChunkTask struct {
 	Attempt     int
 	ClientIP    string
 	ClientIndex int
+	Mirror      int // 0 为源站，i>0 为 bag.Mirrors[i-1]
 }
 type ChunkBuffer struct {
 	Index int64
@@ -95,60 +161,39 @@ type ChunkResult struct {
 
 // ========== 3. 主函数部分 ==========
 
-func (p *NetHTTPCho) ChunkCalculate(AllSize int64) ([]ChunkTask, error) {
-	var chunkTasks []ChunkTask
-	BestChunkSizeRecorder.mu.RLock()
-	var BestChunkSizeContent = BestChunkSizeRecorder.content
-	BestChunkSizeRecorder.mu.RUnlock()
-	snapshot := p.current.Load()
-	if len(snapshot.ChunksEntries) == 0 {
-		return []ChunkTask{}, fmt.Errorf("chunks no probability available")
-	}
-	fmt.Printf("snapshotChunks: %v\n", snapshot.ChunksEntries)
-	var TaskIndex = 0
-	var AllStartPos int64 = 0.0
-	var AllEndPos int64 = 0.0
-	var AllSizePos = AllSize - 1
-	var TaskSizePos int64
-	for i, Entry := range snapshot.ChunksEntries {
-		TaskSize := int64((Entry.ProbNum / snapshot.TotalChunks) * float64(AllSize))
-		fmt.Printf("Entry Index%d: TaskSize%d\n", TaskIndex, TaskSize)
-		if i == len(snapshot.ChunksEntries)-1 {
-			TaskSizePos = AllSizePos
-		} else {
-			TaskSizePos = AllStartPos + TaskSize - 1
-		}
-		BestChunk := BestChunkSizeContent[Entry.IP]
-		if BestChunk <= 0 {
-			BestChunk = 5 * 1024 * 1024
-		}
-		for {
-			if AllStartPos+2*BestChunk-1 <= TaskSizePos {
-				AllEndPos += BestChunk - 1
-				chunkTasks = append(chunkTasks, ChunkTask{Index: TaskIndex, End: AllEndPos, Start: AllStartPos, ClientIP: Entry.IP, ClientIndex: Entry.Index})
-				AllStartPos = AllEndPos + 1
-				AllEndPos = AllStartPos
-				TaskIndex++
-			} else {
-				AllEndPos = TaskSizePos
-				chunkTasks = append(chunkTasks, ChunkTask{Index: TaskIndex, End: AllEndPos, Start: AllStartPos, ClientIP: Entry.IP, ClientIndex: Entry.Index})
-				AllStartPos = AllEndPos + 1
-				AllEndPos = AllStartPos
-				TaskIndex++
-				break
-			}
-		}
-	}
-	return chunkTasks, nil
+// ChunkCalculate 使用Host对应的调度器规划分块，快照先按Host分时规则调整网卡权重
+func (p *NetHTTPCho) ChunkCalculate(host string, AllSize int64) ([]ChunkTask, error) {
+	scheduler := SchedulerFor(host)
+	return scheduler.Plan(weightedSnapshot(host, p.SnapshotFor(scheduler.Name())), AllSize)
 }
-func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) error {
-	// 解析bag内部内容
-	AllSize := bag.AllBytes
-	TargetURL := bag.TargetURL // Maybe the r.url.string()
 
-	// 计算分块
-	TaskChunks, _ := NetCardCho.ChunkCalculate(AllSize)
+// ChunkPlan 分块规划结果：前面的直连分块按序直接写给客户端，剩余分块交给Worker并行下载
+type ChunkPlan struct {
+	Tasks     []ChunkTask
+	Direct    []ChunkTask
+	LeftStart int
+}
+
+// PlanChunks 在写出任何响应之前完成分块规划，失败时调用方仍可以回退为普通转发
+func PlanChunks(host string, AllSize int64, sources int) (ChunkPlan, error) {
+	TaskChunks, err := NetCardCho.ChunkCalculate(host, AllSize)
+	if err != nil {
+		return ChunkPlan{}, err
+	}
+	AssignMirrors(TaskChunks, sources)
 	fmt.Printf("Total Chunks: %v\n", TaskChunks)
+	TaskSizeDirect := AllSize / numWorkers
+	TasksDirect, leftStart, err := ChunksDirectTaskGet(TaskChunks, TaskSizeDirect)
+	if err != nil {
+		return ChunkPlan{}, err
+	}
+	return ChunkPlan{Tasks: TaskChunks, Direct: TasksDirect, LeftStart: leftStart}, nil
+}
+
+func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag, plan ChunkPlan) error {
+	// 解析bag内部内容
+	stream := NewClientStream(bufrw, r, bag)
+	TaskChunks := plan.Tasks
 	lenChunks := len(TaskChunks)
 
 	//与客户端解耦
@@ -162,8 +207,8 @@ func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) error {
 		select {
 		case <-r.Context().Done():
 			if !ContinueOnClientClose {
-				JobCancel(errors.New("client DisConnected"))
-				DirectCancel(errors.New("client DisConnected"))
+				JobCancel(ErrClientGone)
+				DirectCancel(ErrClientGone)
 			}
 		case <-jobCtx.Done():
 			DirectCancel(errors.New("jobCtx Cancel"))
@@ -176,11 +221,7 @@ func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) error {
 	taskCh := make(chan ChunkTask, lenChunks)
 	resultCh := make(chan ChunkResult, 2*numWorkers)
 	// 构建直连形式Worker框架
-	TaskSizeDirect := AllSize / numWorkers
-	TasksDirect, leftStart, err := ChunksDirectTaskGet(TaskChunks, TaskSizeDirect)
-	if err != nil {
-		return err
-	}
+	TasksDirect, leftStart := plan.Direct, plan.LeftStart
 
 	// 提前注入对应后面剩余任务
 	TasksLeft := TaskChunks[leftStart:]
@@ -193,20 +234,29 @@ func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) error {
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
 
+	// 看门狗：卡死或过慢的分块会被取消并改派到其他连接
+	watchdog := NewChunkWatchdog()
+	go watchdog.Run(jobCtx)
+
+	// 直连部分退出后才允许降级逻辑写客户端，避免两边同时写
+	directDone := make(chan struct{})
 	go func() {
-		DirectChunksWok(r.Context(), TasksDirect, bufrw, TargetURL, r.Header)
-		wg.Done()
+		defer close(directDone)
+		defer wg.Done()
+		if err := DirectChunksWok(jobCtx, watchdog, TasksDirect, stream, bag, r.Header); err != nil {
+			JobCancel(err)
+			return
+		}
 		DirectCancel(fmt.Errorf("finished all ChunksDirect"))
 	}()
 
 	for i := 1; i < numWorkers; i++ {
-		go chunkWorker(jobCtx, i, TargetURL, taskCh, resultCh, r.Header, &wg)
+		go chunkWorker(jobCtx, i, watchdog, bag, taskCh, resultCh, r.Header, &wg)
 	}
-	// 等待所有 Worker 完成后关闭结果队列
+	// 等待所有 Worker 完成后关闭结果队列（taskCh 不关闭，重试的延迟回灌可能晚于 Worker 退出）
 	go func() {
 		wg.Wait()
 		close(resultCh)
-		close(taskCh)
 		fmt.Println("✅ 所有下载任务完成")
 	}()
 
@@ -221,9 +271,11 @@ func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) error {
 		case <-jobCtx.Done():
 			// 任务被取消
 			err := context.Cause(jobCtx)
-			if err != nil {
-				fmt.Printf("⚠️ Job canceled: %v\n", err)
+			if err != nil && !errors.Is(err, ErrClientGone) {
+				// 加速失败（分块不合规/重试耗尽/首块失败）：从已交付的位置改为单流继续，客户端无感知
+				return chunksFallback(r, bag, stream, directDone, err)
 			}
+			fmt.Printf("⚠️ Job canceled: %v\n", err)
 			return nil
 		case res, ok := <-resultCh:
 			if !ok {
@@ -234,52 +286,53 @@ func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) error {
 				return nil
 			}
 			if res.Err != nil {
+				if errors.Is(res.Err, ErrChunkMismatch) {
+					JobCancel(res.Err)
+					continue
+				}
 				// 失败的块：决定是否重试
 				if taskRetryable(res.Err) && res.Index >= 0 {
-					// 增加重试次数，回灌任务
+					// 增加重试次数，改派到其他连接后回灌任务
 					attempt := TaskChunks[res.Index].Attempt + 1
-					TaskChunks[res.Index].Attempt = attempt
 					if attempt <= MaxAttempts {
+						retryTask := NetCardCho.ReassignChunk(TaskChunks[res.Index])
+						retryTask.Mirror = bag.NextMirror(retryTask.Mirror)
+						retryTask.Attempt = attempt
+						TaskChunks[res.Index] = retryTask
 						backoff := time.Duration(math.Pow(2, float64(attempt-1))) * 200 * time.Millisecond
 						time.AfterFunc(backoff, func() {
 							select {
-							case taskCh <- ChunkTask{Index: res.Index, Start: TaskChunks[res.Index].Start, End: TaskChunks[res.Index].End, Attempt: attempt}:
+							case taskCh <- retryTask:
 							case <-jobCtx.Done():
 							}
 						})
-						fmt.Printf("🔁 重试 Chunk %d（第 %d 次）\n", res.Index, attempt)
+						fmt.Printf("🔁 重试 Chunk %d（第 %d 次，改派至 %s#%d）: %v\n", res.Index, attempt, retryTask.ClientIP, retryTask.ClientIndex, res.Err)
 						continue
 					}
 				}
-				// 不可重试或超过次数：取消全局
-				JobCancel(fmt.Errorf("fatal: chunk %d failed: %v", res.Index, res.Err))
-				return nil
+				// 不可重试或超过次数：取消全局，由 jobCtx 分支降级
+				JobCancel(fmt.Errorf("fatal: chunk %d failed: %w", res.Index, res.Err))
+				continue
 			}
 			// 成功：缓存并尝试按序写出
 			pending[res.Index] = res.Data
 		case <-DirectCtx.Done():
+			// 直连部分失败时由 jobCtx 分支处理
+			if jobCtx.Err() != nil {
+				continue
+			}
+			if remaining == 0 {
+				fmt.Println("✅ 全部发送完成")
+				return stream.Finish()
+			}
 			// 进行写入操作
 			data, ok := pending[next]
 			if !ok {
 				continue
 			}
-			actualSize := len(data)
-			chunkSize := fmt.Sprintf("%x\r\n", actualSize)
-			if _, err := bufrw.WriteString(chunkSize); err != nil {
-				fmt.Printf("err1: %+v\n", err)
-				return nil
-			}
-			if _, err := bufrw.Write(data); err != nil {
+			if _, err := stream.Write(data); err != nil {
 				// 写回失败：客户端已断开
-				JobCancel(fmt.Errorf("write failed: %w", err))
-				return nil
-			}
-			if _, err := bufrw.WriteString("\r\n"); err != nil {
-				fmt.Printf("err3: %+v\n", err)
-				return nil
-			}
-			if err := bufrw.Flush(); err != nil {
-				JobCancel(fmt.Errorf("flush failed: %w", err))
+				JobCancel(fmt.Errorf("%w: write failed: %v", ErrClientGone, err))
 				return nil
 			}
 			delete(pending, next)
@@ -287,17 +340,35 @@ func ChunksDeal(bufrw *bufio.ReadWriter, r *http.Request, bag ChunkBag) error {
 			remaining--
 			if remaining == 0 {
 				fmt.Println("✅ 全部发送完成")
-				return writeChunkedEnd(bufrw)
+				return stream.Finish()
 			}
 		}
 	} // 这边的逻辑可以尝试1，全放select；2，下面部分的DirectCtx.Done()放在其他select？
 }
 
+// chunksFallback 加速失败后的降级：等待直连部分停止写入，然后用最优网卡单流补齐剩余内容
+// 尚未交付任何字节时重新发起普通请求，否则带Range从已交付偏移续传；分块不合规时同时标记Host不可分块（文件版本不一致只短时间标记）
+func chunksFallback(r *http.Request, bag ChunkBag, stream *ClientStream, directDone <-chan struct{}, cause error) error {
+	<-directDone
+	switch {
+	case errors.Is(cause, ErrChunkVersion):
+		GloNoRangeCache.MarkVersion(r.Host)
+	case errors.Is(cause, ErrChunkMismatch):
+		GloNoRangeCache.MarkHost(r.Host)
+	}
+	fmt.Printf("⚠️ 分块加速失败，降级为单流传输(已交付 %d 字节): %v\n", stream.Delivered(), cause)
+	if err := SingleStreamResume(r.Context(), stream, r.Header, bag); err != nil {
+		return err
+	}
+	return stream.Finish()
+}
+
 // ==========  Worker 函数（关键） ==========
 func chunkWorker(
 	ctx context.Context,
 	workerID int,
-	targetURL string,
+	watchdog *ChunkWatchdog,
+	bag ChunkBag,
 	taskCh <-chan ChunkTask,
 	resultCh chan<- ChunkResult,
 	headers http.Header,
@@ -312,8 +383,15 @@ func chunkWorker(
 			if (task == ChunkTask{}) && len(taskCh) == 0 {
 				return
 			}
-			data, err := downloadOneChunk(ctx, targetURL, task, headers)
-			resultCh <- ChunkResult{Index: task.Index, Data: data, Err: err}
+			chunkCtx, progress, done := watchdog.Track(ctx, task)
+			data, err := downloadOneChunk(chunkCtx, progress, bag, task, headers)
+			err = chunkErr(chunkCtx, err)
+			done()
+			select {
+			case resultCh <- ChunkResult{Index: task.Index, Data: data, Err: err}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
@@ -321,137 +399,235 @@ func chunkWorker(
 // DirectChunksWok ========== 下载前面部分分块保证连接通畅性 ==========
 func DirectChunksWok(
 	ctx context.Context,
+	watchdog *ChunkWatchdog,
 	chunks []ChunkTask,
-	bufrw *bufio.ReadWriter,
-	targetURL string,
+	stream *ClientStream,
+	bag ChunkBag,
 	Headers http.Header,
-) {
-	TaskNum := len(chunks)
-	next := 0
-	//fmt.Printf("TaskNum: %d\n", TaskNum)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			if next >= TaskNum {
-				return
-			}
-			task := chunks[next]
-
-			NetCardClient.mu.RLock()
-			IP := task.ClientIP
-			ClientIndex := task.ClientIndex
-			client := NetCardClient.Content[IP].CommonClient[ClientIndex]
-			//if client != nil {
-			//	fmt.Printf("client: %+v\n", client)
-			//}
-			NetCardClient.mu.RUnlock()
-
-			// 设置对应Req
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
-			if err != nil {
-				return
+) error {
+	for _, task := range chunks {
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			default:
 			}
-			// 设置头部
-			req.Header = Headers.Clone()
-			req.Header = ReqH1ToH2Headers(req.Header)
-			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", task.Start, task.End))
-			fmt.Printf("task: %+v\n", task)
-			// 发送指令
-			resp, err := client.Do(req)
-			//if resp != nil {
-			//	fmt.Printf("resp: %+v\n", resp)
-			//}
-			// 设置bufrw-Copy Writer
-			monitorWriter := &MonitorWriterChunks{
-				Writer:  bufrw,
-				Monitor: NetCardBytes,
-				LocalIP: IP,
-				ctx:     ctx,
-				Index:   ClientIndex,
+			chunkCtx, progress, done := watchdog.Track(ctx, task)
+			err := directOneChunk(chunkCtx, progress, task, stream, bag, Headers)
+			err = chunkErr(chunkCtx, err)
+			done()
+			if err == nil {
+				break
 			}
-			// 发送回客户端
-			actualSize := resp.ContentLength
-			chunkSize := fmt.Sprintf("%x\r\n", actualSize)
-			if _, err = bufrw.WriteString(chunkSize); err != nil {
-				fmt.Printf("err1: %+v\n", err)
-				resp.Body.Close()
-				return
+			if !taskRetryable(err) || attempt >= MaxAttempts || ctx.Err() != nil {
+				return err
 			}
-			_, err = io.Copy(monitorWriter, resp.Body)
-			if err != nil {
-				fmt.Printf("err2: %+v\n", err)
-				resp.Body.Close()
-				return
-			}
-			resp.Body.Close()
-			// 写入结束标记
-			if _, err = bufrw.WriteString("\r\n"); err != nil {
-				fmt.Printf("err3: %+v\n", err)
-				return
+			// 已交付给客户端的部分不再重复，改派后从当前偏移继续该分块剩余区间
+			task.Start = stream.Delivered()
+			if task.Start > task.End {
+				break
 			}
-			bufrw.Flush()
-			next++
+			task = NetCardCho.ReassignChunk(task)
+			task.Mirror = bag.NextMirror(task.Mirror)
+			fmt.Printf("🔁 直连 Chunk %d 从 %d 续传（第 %d 次，改派至 %s#%d）: %v\n", task.Index, task.Start, attempt+1, task.ClientIP, task.ClientIndex, err)
 		}
 	}
+	return nil
+}
+
+// directOneChunk 下载单个分块并直接流式写给客户端
+func directOneChunk(ctx context.Context, progress *TransferProgress, task ChunkTask, stream *ClientStream, bag ChunkBag, Headers http.Header) error {
+	IP := task.ClientIP
+	ClientIndex := task.ClientIndex
+	client, err := NetCardClient.Common(IP, ClientIndex)
+	if err != nil {
+		return fmt.Errorf("retryable: %w", err)
+	}
+	// 记录连接上排队的字节数，供调度器参考
+	counters := NetCardBytes.GetOrCreate(IP)
+	counters.AddOutstanding(ClientIndex, task.End-task.Start+1)
+	defer counters.AddOutstanding(ClientIndex, -(task.End - task.Start + 1))
+
+	// 设置对应Req
+	src := bag.ForMirror(task.Mirror)
+	usedURL := src.URL()
+	traceCtx, edge := traceEdge(ctx)
+	traceCtx, rtt := traceTiming(traceCtx)
+	req, err := http.NewRequestWithContext(traceCtx, http.MethodGet, usedURL, nil)
+	if err != nil {
+		return err
+	}
+	// 设置头部
+	req.Header = pinnedHeaders(Headers, bag, usedURL)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", task.Start, task.End))
+	if v := src.IfRangeValue(); v != "" {
+		req.Header.Set("If-Range", v)
+	}
+	fmt.Printf("task: %+v\n", task)
+	// 发送指令
+	sent := time.Now()
+	resp, err := client.Do(req)
+	GloNICHealth.Report(IP, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	headerAt := time.Now()
+	if err = checkPinnedExpired(ctx, resp, src, usedURL); err != nil {
+		return err
+	}
+	if err = CheckChunkResp(resp, task, src); err != nil {
+		return mirrorErr(task, usedURL, err)
+	}
+	// 设置bufrw-Copy Writer
+	monitorWriter := &MonitorWriterChunks{
+		Writer:  stream,
+		Monitor: NetCardBytes,
+		LocalIP: IP,
+		ctx:     ctx,
+		Index:   ClientIndex,
+	}
+	// 发送回客户端
+	n, err := io.Copy(monitorWriter, &ProgressReader{Reader: resp.Body, Progress: progress})
+	if err != nil {
+		fmt.Printf("err2: %+v\n", err)
+		return err
+	}
+	GloEdgeTracker.Record(IP, req.URL.Hostname(), edge(), n, time.Since(progress.Start))
+	GloChunkSizer.Observe(IP, n, headerAt.Sub(sent), time.Since(headerAt), rtt())
+	return nil
 }
 
 // ========== 下载单个分块（保持不变） ==========
-func downloadOneChunk(ctx context.Context, targetURL string, task ChunkTask, Headers http.Header) ([]byte, error) {
+func downloadOneChunk(ctx context.Context, progress *TransferProgress, bag ChunkBag, task ChunkTask, Headers http.Header) ([]byte, error) {
 
-	// 暂时设置为对应probeClient
+	// 网卡已被移除时改派到其他网卡
 	IP := task.ClientIP
 	ClientIndex := task.ClientIndex
-	NetCardClient.mu.RLock()
-	client := NetCardClient.Content[IP].CommonClient[ClientIndex]
-	if client == nil {
-		fmt.Printf("Client no exist.")
+	client, err := NetCardClient.Common(IP, ClientIndex)
+	if err != nil {
+		return nil, fmt.Errorf("retryable: %w", err)
 	}
-	NetCardClient.mu.RUnlock()
-
-	// 创建请求
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	counters := NetCardBytes.GetOrCreate(IP)
+	counters.AddOutstanding(ClientIndex, task.End-task.Start+1)
+	defer counters.AddOutstanding(ClientIndex, -(task.End - task.Start + 1))
+
+	// 创建请求，记录实际连接的服务器IP与握手耗时
+	src := bag.ForMirror(task.Mirror)
+	usedURL := src.URL()
+	traceCtx, edge := traceEdge(ctx)
+	traceCtx, rtt := traceTiming(traceCtx)
+	req, err := http.NewRequestWithContext(traceCtx, http.MethodGet, usedURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
 
 	// 设置头部
-	req.Header = Headers.Clone()
-	req.Header = ReqH1ToH2Headers(req.Header)
+	req.Header = pinnedHeaders(Headers, bag, usedURL)
 	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", task.Start, task.End))
+	// 携带If-Range：文件版本变化时服务器会返回200整文件，从而被下面的校验拦截
+	if v := src.IfRangeValue(); v != "" {
+		req.Header.Set("If-Range", v)
+	}
 	//fmt.Printf("task: %+v\n", task)
 
+	sent := time.Now()
 	resp, err := client.Do(req)
+	GloNICHealth.Report(IP, err)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	headerAt := time.Now()
+	if err = checkPinnedExpired(ctx, resp, src, usedURL); err != nil {
+		return nil, err
+	}
+	if err = CheckChunkResp(resp, task, src); err != nil {
+		return nil, mirrorErr(task, usedURL, err)
+	}
 	monitorReader := &MonitorReaderChunks{
-		Reader:  resp.Body,
+		Reader:  &ProgressReader{Reader: resp.Body, Progress: progress},
 		Monitor: NetCardBytes,
 		LocalIP: IP,
 		ctx:     ctx,
 		Index:   ClientIndex,
 	}
-	need := resp.ContentLength
-	buf := make([]byte, need)
+	// 按任务区间分配，不再信任响应的 ContentLength
+	buf := make([]byte, task.End-task.Start+1)
 	n, err := io.ReadFull(monitorReader, buf)
+	if err == nil {
+		GloEdgeTracker.Record(IP, req.URL.Hostname(), edge(), int64(n), time.Since(progress.Start))
+		GloChunkSizer.Observe(IP, int64(n), headerAt.Sub(sent), time.Since(headerAt), rtt())
+	}
 	return buf[:n], err
 }
 
-// ========== 6. 辅助函数 ==========
-
-func taskRetryable(err error) bool {
-	return strings.HasPrefix(err.Error(), "retryable:")
-}
+// SingleStreamResume 使用最优网卡的单条连接，从客户端已交付的偏移处继续传输剩余内容
+func SingleStreamResume(ctx context.Context, stream *ClientStream, Headers http.Header, bag ChunkBag) error {
+	IP, err := NetCardCho.getBestProbeIP()
+	if err != nil {
+		return err
+	}
+	client, err := NetCardClient.Common(IP, 0)
+	if err != nil {
+		return err
+	}
 
-func writeChunkedEnd(bufrw *bufio.ReadWriter) error {
-	_, err := bufrw.WriteString("0\r\n\r\n")
+	offset := stream.Delivered()
+	usedURL := bag.URL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, usedURL, nil)
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header = pinnedHeaders(Headers, bag, usedURL)
+	req.Header.Del("Range")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if v := bag.IfRangeValue(); v != "" {
+			req.Header.Set("If-Range", v)
+		}
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
-	return bufrw.Flush()
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, _, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			return fmt.Errorf("single stream resume: want offset %d, got %q", offset, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// 服务器忽略了Range：版本一致时丢弃已交付部分后继续
+		if offset > 0 {
+			if !bag.SameVersion(resp.Header) {
+				return fmt.Errorf("single stream resume: file changed after %d bytes delivered", offset)
+			}
+			if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("single stream resume: status %d", resp.StatusCode)
+	}
+
+	monitorWriter := &MonitorWriterChunks{
+		Writer:  stream,
+		Monitor: NetCardBytes,
+		LocalIP: IP,
+		ctx:     ctx,
+		Index:   0,
+	}
+	_, err = io.CopyN(monitorWriter, resp.Body, bag.AllBytes-offset)
+	return err
+}
+
+// ========== 6. 辅助函数 ==========
+
+func taskRetryable(err error) bool {
+	return strings.HasPrefix(err.Error(), "retryable:")
 }
 
 // ChunksDirectTaskGet 用来保持前面部分的持续性下载
@@ -27,6 +27,14 @@ var GloUserConfig = &UserConfig{
 
 // 本程序用来进行基本初始化，并实现GUI界面方便Windows用户使用
 func main() {
+	// 子命令：routing check/install
+	if len(os.Args) > 1 && os.Args[1] == "routing" {
+		if err := GloNetCardConfig.LoadConfig(); err != nil {
+			fmt.Println("Load NetCard Config Error", err)
+		}
+		RoutingCLI(os.Args[2:])
+		return
+	}
 	GloUserConfig.mu.RLock()
 	Addr := GloUserConfig.Content.ListenAddr
 	Port := GloUserConfig.Content.ListenPort
@@ -53,11 +61,24 @@ func main() {
 	if err := InstallCertToSystem(); err != nil {
 		fmt.Printf("警告：自动安装证书失败 (请尝试右键以管理员身份运行): %v\n", err)
 	}
+	// 按网络环境选择配置方案（决定下面加载的策略与网卡配置文件）
+	if err = GloProfiles.LoadProfiles(); err != nil {
+		fmt.Println("Load Profiles Error", err)
+	}
+	GloProfiles.Init()
 	//	初始化对应Policy策略
 	err = GlobalPolicyManager.LoadPolicies()
 	if err != nil {
 		fmt.Println("Load Policy Error")
 	}
+	// 初始化网卡配置
+	if err = GloNetCardConfig.LoadConfig(); err != nil {
+		fmt.Println("Load NetCard Config Error", err)
+	}
+
+	// 读取计费网卡的历史用量
+	GloQuota.UsageLoad()
+	defer GloQuota.SaveLocal()
 
 	// 初始化调用网卡测速
 	NetCardCLI()
@@ -72,6 +93,14 @@ func main() {
 
 	// 构建退出方式
 	go EndKeyMonitor(cancel)
+	// 运行期间监听网卡的插拔
+	go WatchNetCards(ctx)
+	// 网卡健康检查
+	go RunHealthChecks(ctx)
+	// 检测共享同一上游的网卡
+	go GloSharedUpstream.Detect(ctx)
+	// 计费网卡的用量统计
+	go GloQuota.Run(ctx)
 
 	// 创建对应等待组进行有关协程执行内容
 	var wg sync.WaitGroup
@@ -88,6 +117,11 @@ func EndKeyMonitor(cancel context.CancelFunc) {
 		input, _ := reader.ReadString('\n')
 		// 清理输入字符串，只保留第一个字符并转换为小写
 		input = strings.TrimSpace(input)
+		// profile [名称|auto]：查看或切换配置方案
+		if fields := strings.Fields(input); len(fields) > 0 && strings.ToLower(fields[0]) == "profile" {
+			ProfileCommand(fields[1:])
+			continue
+		}
 		if len(input) > 0 {
 			char := strings.ToLower(input)[0]
 			if char == 'q' {
@@ -80,7 +80,7 @@ func handleConnection(conn net.Conn) {
 			go HttpsHandle(tlsConn)
 		} else {
 			HostPort := net.JoinHostPort(Host, "443")
-			targetConn, err := net.Dial("tcp", HostPort)
+			targetConn, err := DialPassThrough(context.Background(), HostPort)
 			if err != nil {
 				fmt.Printf("连接服务器出现错误: %v\n", err)
 				conn.Close()
@@ -90,7 +90,7 @@ func handleConnection(conn net.Conn) {
 		}
 	} else {
 		HostPort := net.JoinHostPort(Host, "80")
-		targetConn, err := net.Dial("tcp", HostPort)
+		targetConn, err := DialPassThrough(context.Background(), HostPort)
 		if err != nil {
 			fmt.Printf("连接服务器出现错误: %v\n", err)
 			conn.Close()
@@ -134,7 +134,7 @@ func certHandler(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	}
 
 	// 3. 针对伪造证书的创建
-	targetConn, err := net.Dial("tcp", TargetSNI)
+	targetConn, err := DialPassThrough(context.Background(), TargetSNI)
 	if err != nil {
 		return nil, fmt.Errorf("无法连接到目标服务器 %s: %w", TargetSNI, err)
 	}
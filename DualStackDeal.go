@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// 双栈：每张网卡分别给出一个可用的IPv4与IPv6源地址，各自作为独立的"路径"创建Transport、测速与调度
+// （调度器把同一网卡的v4/v6当作两条可分别度量的路径）
+// 同一网卡的另一地址族地址称为 sibling：
+//   - NICDialContext（Probe/直通/健康检查等）在本地址族与 sibling 之间做 Happy Eyeballs（RFC 8305）
+//   - EdgeDialContext（分块连接）只在目标没有本地址族地址时才改用 sibling，保证路径的测量不混杂
+
+const HappyEyeballsDelay = 300 * time.Millisecond // 首选地址族先行的时间
+
+type NICSiblings struct {
+	mu      sync.RWMutex
+	sibling map[string]string // 源地址 -> 同一网卡另一地址族的源地址
+	names   map[string]string // 源地址 -> 网卡名
+}
+
+var GloSiblings = &NICSiblings{
+	sibling: make(map[string]string),
+	names:   make(map[string]string),
+}
+
+// Update 按网卡名把扫描结果中的v4/v6地址配对
+func (s *NICSiblings) Update(found map[string]*NetCardInfoPara) {
+	byName := make(map[string][]string)
+	names := make(map[string]string)
+	for IP, Info := range found {
+		byName[Info.Name] = append(byName[Info.Name], IP)
+		names[IP] = Info.Name
+	}
+	sibling := make(map[string]string)
+	for _, IPs := range byName {
+		if len(IPs) == 2 && isIPv4(IPs[0]) != isIPv4(IPs[1]) {
+			sibling[IPs[0]] = IPs[1]
+			sibling[IPs[1]] = IPs[0]
+		}
+	}
+	s.mu.Lock()
+	s.sibling = sibling
+	s.names = names
+	s.mu.Unlock()
+}
+
+// Name 源地址所在的网卡名
+func (s *NICSiblings) Name(LocalIP string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.names[LocalIP]
+}
+
+// Sibling 同一网卡另一地址族的源地址，没有时返回空
+func (s *NICSiblings) Sibling(LocalIP string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sibling[LocalIP]
+}
+
+func isIPv4(IP string) bool {
+	return net.ParseIP(IP).To4() != nil
+}
+
+// usableIPv6 可作为出口的IPv6地址：全局单播，排除链路本地与ULA
+func usableIPv6(IP net.IP) bool {
+	return IP.To4() == nil && IP.IsGlobalUnicast() && !IP.IsPrivate()
+}
+
+// sourceFor 连接指定地址时应使用的源地址：地址族不一致时改用 sibling
+func sourceFor(LocalIP string, remote net.IP) string {
+	if (remote.To4() != nil) == isIPv4(LocalIP) {
+		return LocalIP
+	}
+	if sib := GloSiblings.Sibling(LocalIP); sib != "" {
+		return sib
+	}
+	return LocalIP
+}
+
+// withSource 复制一份拨号器并替换源地址
+func withSource(dialer *net.Dialer, network string, IP string) *net.Dialer {
+	d := *dialer
+	if network == "udp" || network == "udp4" || network == "udp6" {
+		d.LocalAddr = &net.UDPAddr{IP: net.ParseIP(IP)}
+	} else {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(IP)}
+	}
+	return &d
+}
+
+// dialPlan 一个源地址及其可连接的目标地址
+type dialPlan struct {
+	dialer *net.Dialer
+	IPs    []net.IP
+}
+
+// dialSerial 依次尝试目标地址
+func dialSerial(ctx context.Context, network string, port string, plan dialPlan) (net.Conn, error) {
+	if len(plan.IPs) == 0 {
+		return nil, errors.New("no address")
+	}
+	var lastErr error
+	for _, IP := range plan.IPs {
+		conn, err := plan.dialer.DialContext(ctx, network, net.JoinHostPort(IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialHappyEyeballs 首选计划先行，HappyEyeballsDelay 后或首选失败时启动备选，先成功者胜出
+func dialHappyEyeballs(ctx context.Context, network string, port string, primary dialPlan, fallback dialPlan) (net.Conn, error) {
+	if len(fallback.IPs) == 0 {
+		return dialSerial(ctx, network, port, primary)
+	}
+	if len(primary.IPs) == 0 {
+		return dialSerial(ctx, network, port, fallback)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	start := func(plan dialPlan) {
+		go func() {
+			conn, err := dialSerial(ctx, network, port, plan)
+			results <- result{conn, err}
+		}()
+	}
+	start(primary)
+	timer := time.NewTimer(HappyEyeballsDelay)
+	defer timer.Stop()
+	started, pending := 1, 1
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if started == 1 {
+				start(fallback)
+				started, pending = 2, pending+1
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// 另一路稍后成功的连接直接关闭
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if started == 1 {
+				start(fallback)
+				started, pending = 2, pending+1
+				continue
+			}
+			if pending == 0 {
+				return nil, fmt.Errorf("happy eyeballs: %w", firstErr)
+			}
+		}
+	}
+}
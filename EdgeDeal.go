@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 多服务器地址：分块连接不再全部落到系统解析出的同一个CDN节点上
+// AddTransportCom 创建的连接在拨号时经该网卡解析目标的全部 A/AAAA 记录并轮流使用，
+// 按 (网卡, 服务器IP) 记录分块吞吐，明显慢于同网卡最快节点的服务器IP暂时移出轮转
+
+const (
+	EdgeMinSamples = 3               // 参与快慢比较前至少需要的分块样本数
+	EdgeSlowRatio  = 0.5             // 低于同网卡最快节点该比例即判定为慢节点
+	EdgeDropTTL    = 5 * time.Minute // 慢节点移出轮转的时长，到期后重新参与
+	EdgeEWMAAlpha  = 0.3
+)
+
+// EdgeStat 单条 (网卡, Host, 服务器IP) 路径的吞吐统计
+type EdgeStat struct {
+	Rate         float64 // B/s 的EWMA
+	Samples      int
+	DroppedUntil time.Time
+}
+
+type EdgeTracker struct {
+	mu         sync.Mutex
+	addrs      map[string][]net.IP  // key: 网卡IP|Host
+	stats      map[string]*EdgeStat // key: 网卡IP|Host|服务器IP
+	next       map[string]int       // Host 的轮转计数
+	transports map[string][]*http.Transport
+}
+
+var GloEdgeTracker = &EdgeTracker{
+	addrs:      make(map[string][]net.IP),
+	stats:      make(map[string]*EdgeStat),
+	next:       make(map[string]int),
+	transports: make(map[string][]*http.Transport),
+}
+
+func edgeKey(LocalIP string, host string, edge string) string {
+	return LocalIP + "|" + host + "|" + edge
+}
+
+// Register 登记网卡的分块Transport，节点被移出时关闭空闲连接促使重新拨号
+func (t *EdgeTracker) Register(LocalIP string, transport *http.Transport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.transports[LocalIP] = append(t.transports[LocalIP], transport)
+}
+
+// Forget 网卡被移除时清除它的Transport与节点统计
+func (t *EdgeTracker) Forget(LocalIP string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.transports, LocalIP)
+	prefix := LocalIP + "|"
+	for key := range t.addrs {
+		if strings.HasPrefix(key, prefix) {
+			delete(t.addrs, key)
+		}
+	}
+	for key := range t.stats {
+		if strings.HasPrefix(key, prefix) {
+			delete(t.stats, key)
+		}
+	}
+}
+
+// Resolve 经网卡解析Host的全部地址（缓存由 GloDNSCache 负责），并记下供快慢比较使用
+func (t *EdgeTracker) Resolve(ctx context.Context, LocalIP string, host string) ([]net.IP, error) {
+	IPs, err := LookupNIC(ctx, LocalIP, host)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.addrs[LocalIP+"|"+host] = IPs
+	t.mu.Unlock()
+	return IPs, nil
+}
+
+// Pick 在未被移出的服务器地址中轮转，返回本次拨号的尝试顺序；全部被移出时仍按原顺序使用
+func (t *EdgeTracker) Pick(LocalIP string, host string, IPs []net.IP) []net.IP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var healthy []net.IP
+	for _, IP := range IPs {
+		if stat, ok := t.stats[edgeKey(LocalIP, host, IP.String())]; ok && now.Before(stat.DroppedUntil) {
+			continue
+		}
+		healthy = append(healthy, IP)
+	}
+	if len(healthy) == 0 {
+		healthy = IPs
+	}
+	start := t.next[host] % len(healthy)
+	t.next[host]++
+	return append(append([]net.IP{}, healthy[start:]...), healthy[:start]...)
+}
+
+// Record 记录一个分块在 (网卡, 服务器IP) 上的吞吐，并检查该节点是否明显慢于同网卡的其他节点
+func (t *EdgeTracker) Record(LocalIP string, host string, edge string, n int64, elapsed time.Duration) {
+	if edge == "" || n <= 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(n) / elapsed.Seconds()
+	t.mu.Lock()
+	key := edgeKey(LocalIP, host, edge)
+	stat, ok := t.stats[key]
+	if !ok {
+		stat = &EdgeStat{Rate: rate}
+		t.stats[key] = stat
+	} else {
+		stat.Rate = EdgeEWMAAlpha*rate + (1-EdgeEWMAAlpha)*stat.Rate
+	}
+	stat.Samples++
+	edges := t.addrs[LocalIP+"|"+host]
+	if stat.Samples < EdgeMinSamples || len(edges) < 2 {
+		t.mu.Unlock()
+		return
+	}
+	best := 0.0
+	now := time.Now()
+	for _, IP := range edges {
+		other, ok := t.stats[edgeKey(LocalIP, host, IP.String())]
+		if !ok || other.Samples < EdgeMinSamples || now.Before(other.DroppedUntil) {
+			continue
+		}
+		best = math.Max(best, other.Rate)
+	}
+	if best <= 0 || stat.Rate >= best*EdgeSlowRatio {
+		t.mu.Unlock()
+		return
+	}
+	// 移出轮转，到期后从零开始重新统计
+	fmt.Printf("🐢 %s 经 %s 访问节点 %s 过慢 (%.2f MB/s，最快 %.2f MB/s)，暂时移出轮转\n",
+		host, LocalIP, edge, stat.Rate/(1024*1024), best/(1024*1024))
+	t.stats[key] = &EdgeStat{DroppedUntil: now.Add(EdgeDropTTL)}
+	transports := t.transports[LocalIP]
+	t.mu.Unlock()
+	for _, transport := range transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// EdgeDialContext 按服务器地址轮转拨号；地址族与网卡不一致的记录会被跳过
+func EdgeDialContext(LocalIP string, dialer *net.Dialer) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return countedDial(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		IPs, err := GloEdgeTracker.Resolve(ctx, LocalIP, host)
+		if err != nil {
+			return nil, err
+		}
+		usable := sameFamily(LocalIP, IPs)
+		if len(usable) == 0 {
+			// 目标没有本地址族的地址时才改用同网卡的另一地址族
+			if sib := GloSiblings.Sibling(LocalIP); sib != "" && len(sameFamily(sib, IPs)) > 0 {
+				return dialSerial(ctx, network, port, dialPlan{dialer: withSource(dialer, network, sib), IPs: sameFamily(sib, IPs)})
+			}
+			return nil, fmt.Errorf("no address of %s reachable from %s", host, LocalIP)
+		}
+		var lastErr error
+		for _, IP := range GloEdgeTracker.Pick(LocalIP, host, usable) {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	})
+}
+
+// traceEdge 记录请求实际使用的服务器IP
+func traceEdge(ctx context.Context) (context.Context, func() string) {
+	var mu sync.Mutex
+	var edge string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if tcp, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				mu.Lock()
+				edge = tcp.IP.String()
+				mu.Unlock()
+			}
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return edge
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 普通转发（非分块）时的中途故障转移：上游网卡断开后，换一张网卡带Range从当前偏移继续，客户端响应不中断
+
+// ResumeSpan 描述当前响应在源文件中的区间以及续传所需的校验值
+type ResumeSpan struct {
+	Start     int64
+	End       int64 // -1 表示直到文件结尾
+	Validator string
+	OK        bool
+}
+
+// resumableSpan 判断响应能否中途续传：必须是GET、源站声明 Accept-Ranges: bytes 且带有 ETag/Last-Modified
+// 需要在改写响应头之前调用
+func resumableSpan(r *http.Request, resp *http.Response) ResumeSpan {
+	if r.Method != http.MethodGet || !strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+		return ResumeSpan{}
+	}
+	validator := ChunkBag{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}.IfRangeValue()
+	if validator == "" {
+		return ResumeSpan{}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.ContentLength > 0 {
+			return ResumeSpan{Start: 0, End: resp.ContentLength - 1, Validator: validator, OK: true}
+		}
+		return ResumeSpan{Start: 0, End: -1, Validator: validator, OK: true}
+	case http.StatusPartialContent:
+		start, end, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		return ResumeSpan{Start: start, End: end, Validator: validator, OK: ok}
+	}
+	return ResumeSpan{}
+}
+
+// upstreamReader 记录上游读取错误，用来区分“上游断开”和“客户端写失败”
+type upstreamReader struct {
+	Reader io.Reader
+	err    error
+}
+
+func (u *upstreamReader) Read(p []byte) (n int, err error) {
+	n, err = u.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+	return n, err
+}
+
+// countWriter 统计已经写给客户端的字节数
+type countWriter struct {
+	Writer io.Writer
+	n      int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.Writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// CopyWithFailover 流式拷贝上游Body到客户端；上游读取出错且响应可续传时，最多改派 MaxAttempts 次
+func CopyWithFailover(ctx context.Context, r *http.Request, bag ChunkBag, span ResumeSpan, body io.Reader, monitorWriter *MonitorWriterProbe) error {
+	counter := &countWriter{Writer: monitorWriter}
+	usedIP := monitorWriter.LocalIP
+	for attempt := 0; ; attempt++ {
+		upstream := &upstreamReader{Reader: body}
+		_, err := io.Copy(counter, upstream)
+		if err == nil {
+			return nil
+		}
+		// 客户端写失败、不可续传、客户端已断开：直接结束
+		if upstream.err == nil || !span.OK || attempt >= MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		offset := span.Start + counter.n
+		resp, IP, rerr := resumeOnOtherNIC(ctx, r, bag, usedIP, offset, span)
+		if rerr != nil {
+			fmt.Printf("❌ 中途续传失败: %v\n", rerr)
+			return err
+		}
+		fmt.Printf("🔁 上游中断(%v)，改由 %s 从 %d 续传\n", err, IP, offset)
+		defer resp.Body.Close()
+		usedIP = IP
+		monitorWriter.LocalIP = IP
+		body = resp.Body
+	}
+}
+
+// resumeOnOtherNIC 在其他网卡上重新发起 Range/If-Range 请求，只接受起点正确的206
+func resumeOnOtherNIC(ctx context.Context, r *http.Request, bag ChunkBag, exceptIP string, offset int64, span ResumeSpan) (*http.Response, string, error) {
+	IP, err := NetCardCho.getProbeClientExcept(exceptIP)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return nil, "", err
+	}
+
+	usedURL := bag.URL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, usedURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header = pinnedHeaders(r.Header, bag, usedURL)
+	if span.End >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, span.End))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	req.Header.Set("If-Range", span.Validator)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("resume status %d (file changed or range ignored)", resp.StatusCode)
+	}
+	if start, _, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != offset {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("resume want offset %d, got %q", offset, resp.Header.Get("Content-Range"))
+	}
+	return resp, IP, nil
+}
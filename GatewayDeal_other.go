@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package main
+
+// gatewayMACSupported 能否读取网关MAC，不支持时方案不能按网关MAC匹配
+const gatewayMACSupported = false
+
+// defaultGateways 其他系统暂不读取默认网关
+func defaultGateways() map[string]string {
+	return map[string]string{}
+}
+
+// gatewayMAC 其他系统不读取网关MAC，只依据公网出口判断
+func gatewayMAC(name string) string {
+	return ""
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Windows 上的默认网关与网关MAC：GetAdaptersInfo 给出各网卡（IPv4）的网关，SendARP 解析网关MAC
+
+// gatewayMACSupported 能否读取网关MAC，不支持时方案不能按网关MAC匹配
+const gatewayMACSupported = true
+
+var procSendARP = syscall.NewLazyDLL("iphlpapi.dll").NewProc("SendARP")
+
+// adaptersInfo 读取网卡列表，缓冲区不够时按返回的长度重试
+func adaptersInfo() *syscall.IpAdapterInfo {
+	size := uint32(16 * 1024)
+	for i := 0; i < 3; i++ {
+		buf := make([]byte, size)
+		info := (*syscall.IpAdapterInfo)(unsafe.Pointer(&buf[0]))
+		err := syscall.GetAdaptersInfo(info, &size)
+		if err == nil {
+			return info
+		}
+		if err != syscall.ERROR_BUFFER_OVERFLOW {
+			return nil
+		}
+	}
+	return nil
+}
+
+// cString 截取到第一个NUL
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// defaultGateways 按网卡索引找到网卡名（与 net.Interfaces 一致），取第一个有效的网关
+func defaultGateways() map[string]string {
+	gateways := make(map[string]string)
+	for info := adaptersInfo(); info != nil; info = info.Next {
+		iface, err := net.InterfaceByIndex(int(info.Index))
+		if err != nil {
+			continue
+		}
+		for gw := &info.GatewayList; gw != nil; gw = gw.Next {
+			IP := net.ParseIP(cString(gw.IpAddress.String[:]))
+			if IP != nil && !IP.IsUnspecified() {
+				gateways[iface.Name] = IP.String()
+				break
+			}
+		}
+	}
+	return gateways
+}
+
+// gatewayMAC 以网卡自己的IPv4为源地址向默认网关发送ARP（有缓存时直接返回）
+func gatewayMAC(name string) string {
+	gw := net.ParseIP(defaultGateways()[name]).To4()
+	if gw == nil {
+		return ""
+	}
+	var src net.IP
+	if iface, err := net.InterfaceByName(name); err == nil {
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+					src = ipnet.IP.To4()
+					break
+				}
+			}
+		}
+	}
+	var srcAddr uint32
+	if src != nil {
+		srcAddr = *(*uint32)(unsafe.Pointer(&src[0]))
+	}
+	// IPAddr 为内存中的网络字节序
+	dstAddr := *(*uint32)(unsafe.Pointer(&gw[0]))
+	var mac [8]byte
+	size := uint32(len(mac))
+	ret, _, _ := procSendARP.Call(uintptr(dstAddr), uintptr(srcAddr), uintptr(unsafe.Pointer(&mac[0])), uintptr(unsafe.Pointer(&size)))
+	if ret != 0 || size != 6 {
+		return ""
+	}
+	return net.HardwareAddr(mac[:6]).String()
+}
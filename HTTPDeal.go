@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -33,7 +35,7 @@ func (m *MonitorWriterProbe) Write(p []byte) (n int, err error) {
 	n, err = m.Writer.Write(p)
 	counters := m.Monitor.GetOrCreate(m.LocalIP)
 	counters.clientProbeBytes.Add(int64(n))
-	
+
 	// 这样子保证只进行一次相关的处理优先性加载策略
 	if m.ifFlush != true {
 		m.bytes.Add(int64(n))
@@ -54,16 +56,17 @@ func HttpsHandle(tlsConn net.Conn) {
 		HandReq(w, r, &ReqNum)
 	}) // ?疑问，这个不就是Monitor里面的client里面设计的
 	server := &http.Server{
-		Handler:      handler,
-		ReadTimeout:  30 * time.Second, // 读取请求超时时间
-		WriteTimeout: 30 * time.Second, // 发送请求超时时间
-		IdleTimeout:  90 * time.Second, // 空闲连接超时时间
-		BaseContext:  nil,
+		Handler: handler,
+		// 只限制读取请求头：ReadTimeout/WriteTimeout 是整个请求的绝对时长，会截断慢速的大文件传输
+		// 写超时由 idleWriteConn 按空闲时间处理
+		ReadHeaderTimeout: 30 * time.Second, // 读取请求头超时时间
+		IdleTimeout:       90 * time.Second, // 空闲连接超时时间
+		BaseContext:       nil,
 		//func(net.Listener) context.Context {
 		//	return context.Background()
 		//}
 	}
-	listener := newSingleConnListener(tlsConn)
+	listener := newSingleConnListener(&idleWriteConn{Conn: tlsConn, idle: ServerWriteIdle})
 	err := server.Serve(listener)
 	if err != nil {
 		fmt.Printf("server serve err:%s\n", err.Error())
@@ -103,9 +106,51 @@ func (l *singleConnListener) Addr() net.Addr {
 }
 
 type ChunkBag struct {
-	TargetURL string
-	AllBytes  int64
-	stateCode int64
+	TargetURL    string
+	AllBytes     int64
+	stateCode    int64
+	ETag         string // 探测阶段拿到的校验值，所有分块都要与之一致
+	LastModified string
+	Header       http.Header // 源站响应头，用来构建加速响应
+	HeaderStatus int         // Header 所属响应的状态码，206 时其中的 Content-MD5/Content-Digest 只针对返回的部分
+	Pin          *PinnedURL  // 经过重定向时固定的最终地址，nil表示没有重定向
+	Digest       string      // 期望的内容摘要（如registry镜像层的 sha256:<hex>），为空不校验
+	Mirrors      []Mirror    // 已校验的镜像源，分块可以分散到这些地址
+}
+
+// URL 分块请求实际使用的地址：有重定向时使用固定的最终地址（可能被重新解析）
+func (b ChunkBag) URL() string {
+	if b.Pin != nil {
+		return b.Pin.Get()
+	}
+	return b.TargetURL
+}
+
+// OriginURL 客户端请求的原始URL（跟随重定向之前），缓存以它为键
+func (b ChunkBag) OriginURL() string {
+	if b.Pin != nil {
+		return b.Pin.origin
+	}
+	return b.TargetURL
+}
+
+// IfRangeValue 返回用于 If-Range 的校验值：强ETag优先，其次Last-Modified
+func (b ChunkBag) IfRangeValue() string {
+	if b.ETag != "" && !strings.HasPrefix(b.ETag, "W/") {
+		return b.ETag
+	}
+	return b.LastModified
+}
+
+// SameVersion 判断响应头中的ETag/Last-Modified是否和探测时一致（缺失的一方不做判断）
+func (b ChunkBag) SameVersion(h http.Header) bool {
+	if etag := h.Get("ETag"); b.ETag != "" && etag != "" && strings.TrimPrefix(etag, "W/") != strings.TrimPrefix(b.ETag, "W/") {
+		return false
+	}
+	if lm := h.Get("Last-Modified"); b.LastModified != "" && lm != "" && lm != b.LastModified {
+		return false
+	}
+	return true
 }
 
 func HandReq(w http.ResponseWriter, r *http.Request, ReqNum *atomic.Int64) {
@@ -130,6 +175,10 @@ func HandReq(w http.ResponseWriter, r *http.Request, ReqNum *atomic.Int64) {
 	err = NetCardClient.ProbeFile(ctx, TargetURL, r, w)
 	if err != nil {
 		fmt.Printf("error happened: %v\n", err)
+		// 校验失败时响应头已经发出，中止连接而不是正常结束，避免客户端把截断的内容当作完整文件
+		if errors.Is(err, ErrDigestMismatch) {
+			panic(http.ErrAbortHandler)
+		}
 		return
 	}
 	//if ifChunks {
@@ -148,15 +197,10 @@ func (p *NetHTTPClient) ProbeFile(ctx context.Context, targetURL string, r *http
 		return err
 	}
 	// 设置为对应probeClient
-	NetCardClient.mu.RLock()
-	client := NetCardClient.Content[IP].ProbeClient
-	if client == nil {
-		fmt.Printf("Client no exist.")
-		return
-	} else {
-		//fmt.Printf("client exist: %+v \n", client)
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return err
 	}
-	NetCardClient.mu.RUnlock()
 
 	// 初始情况设置
 	bag.AllBytes = -1
@@ -169,12 +213,15 @@ func (p *NetHTTPClient) ProbeFile(ctx context.Context, targetURL string, r *http
 	}
 	upStreamReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, body)
 
+	ifFound, URLSize, stateCode := URLCheck(targetURL)
+
 	// 头部处理策略 - 发送到上游时需要删除的headers
 	upStreamReq.Header = r.Header.Clone() // 快速拷贝
 	upStreamReq.Header = ReqH1ToH2Headers(upStreamReq.Header)
 
 	// 获取resp
 	resp, err := client.Do(upStreamReq)
+	GloNICHealth.Report(IP, err)
 	if err != nil {
 		select {
 		case <-ctx.Done():
@@ -188,33 +235,67 @@ func (p *NetHTTPClient) ProbeFile(ctx context.Context, targetURL string, r *http
 		resp.Body.Close()
 	}()
 
+	// GET/HEAD 遇到重定向时由代理跟随到最终地址，客户端收到的仍是原始URL对应的内容
+	if isRedirectStatus(resp.StatusCode) && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		final, err := FollowRedirects(ctx, client, resp, upStreamReq.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return fmt.Errorf("follow redirect: %w", err)
+		}
+		resp = final
+		bag.Pin = NewPinnedURL(targetURL, resp.Request.URL.String(), r.Header)
+		fmt.Printf("重定向已解析: %s -> %s\n", targetURL, bag.Pin.Get())
+	}
+
 	// Client Range
 	//fmt.Printf("客户端请求Range: %s\n", r.Header.Get("Range"))
 	//处理resp，如果是chunks，即可返回
 	bag.TargetURL = resp.Request.URL.String() // 如果后面发现无用的话，会将这个优化掉
-	ifFound, URLSize, stateCode := URLCheck(targetURL)
+	bag.ETag = resp.Header.Get("ETag")
+	bag.LastModified = resp.Header.Get("Last-Modified")
+	bag.Header = resp.Header.Clone()
+	bag.HeaderStatus = resp.StatusCode
+	// 只加速GET（HEAD直接按源站响应头返回）；曾经返回过不合规分块的Host不再进行加速
+	// 客户端自带 Range 的续传请求直接转发源站的206，加速响应总是完整文件的200
+	accelerable := r.Method == http.MethodGet && r.Header.Get("Range") == "" && !GloNoRangeCache.IsNoRange(r.Host)
+	threshold := ChunkThreshold(r)
+	if digest, ok := RegistryBlobDigest(r); ok {
+		bag.Digest = digest
+	}
 	// 优先进行对应查找哈希表(very fast)
-	if URLSize >= ExceedSize {
+	if URLSize >= threshold && accelerable {
 		ifChunks = true
 		bag.AllBytes = URLSize
 		bag.stateCode = stateCode
 		// fmt.Printf("Record-statusCode: %d\n", stateCode)
 		fmt.Printf("Chunks Deal Start！\n")
-		chunksProbe(w, r, bag)
-		return nil
+		if chunksProbe(w, r, bag) {
+			return nil
+		}
 	} else if URLSize == -2 { // 针对一些网站本身就是未知大小的情况进行区分
 		var fileSize int64
 		var fileCode int64
-		ifChunks, fileSize, fileCode, err = RespDeal(resp.Header, resp.StatusCode)
+		ifChunks, fileSize, fileCode, err = RespDeal(resp.Header, resp.StatusCode, threshold)
+		// 响应为chunked传输或缺少Accept-Ranges时，才发起 Range: bytes=0-0 探测，依据结果升级为分块
+		if err == nil && !ifChunks && accelerable && NeedsRangeProbe(resp, threshold) {
+			probeCtx, cancel := context.WithCancel(ctx)
+			res, ok := waitProbe(probeCtx, StartRangeProbe(probeCtx, IP, targetURL, r.Header))
+			cancel()
+			if ok && UpgradeByProbe(res, resp, &bag, threshold) {
+				fmt.Printf("探测确认支持Range，升级为分块加速: %d bytes\n", bag.AllBytes)
+				ifChunks, fileSize, fileCode = true, bag.AllBytes, http.StatusOK
+			}
+		}
 		if err == nil {
 			bag.AllBytes = fileSize
 			bag.stateCode = fileCode
 			URLSave(targetURL, fileCode, fileSize)
 			// fmt.Printf("Search-statusCode: %d\n", fileCode)
-			if ifChunks == true {
+			if ifChunks == true && accelerable {
 				fmt.Printf("Chunks Deal Start！\n")
-				chunksProbe(w, r, bag)
-				return nil
+				if chunksProbe(w, r, bag) {
+					return nil
+				}
 			}
 		}
 	} else if URLSize == 0 && stateCode == 200 {
@@ -230,16 +311,29 @@ func (p *NetHTTPClient) ProbeFile(ctx context.Context, targetURL string, r *http
 	if _, ok := w.(http.Flusher); ok {
 		flusher = w.(http.Flusher)
 	}
+	// registry镜像层在普通转发时同样校验digest（小于分块阈值、大小未知、降级为单连接等情况）
+	var verifier *VerifyingWriter
+	if r.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+		verifier = NewVerifyingWriter(w, bag)
+	}
+	var out http.ResponseWriter = w
+	if verifier != nil {
+		out = verifier
+	}
 	monitorWriter := &MonitorWriterProbe{
-		Writer:  w,
+		Writer:  out,
 		Monitor: NetCardBytes,
 		LocalIP: IP,
 		ctx:     ctx,
 		flusher: flusher,
 	}
+	// 在改写响应头之前判断能否中途续传
+	span := resumableSpan(r, resp)
 	//resp.Header.Set("Content-Length", strconv.FormatInt(URLSize, 10)) 存在问题，对于部分文件大小未经过探测到的
 	resp.Header.Set("Accept-Ranges", "bytes")
-	resp.Header.Del("Content-Range")
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Header.Del("Content-Range")
+	}
 	resp.Header.Del("Transfer-Encoding")
 	resp.Header.Del("Connection")
 	// 复制响应headers到客户端，同时删除不应该传递的headers
@@ -250,7 +344,8 @@ func (p *NetHTTPClient) ProbeFile(ctx context.Context, targetURL string, r *http
 	}
 	w.WriteHeader(resp.StatusCode) // 这里最好还是别用stateCode，避免出现-1的情况。客户端自行进行处理。
 	monitorWriter.ifFlush = false
-	_, err = io.Copy(monitorWriter, resp.Body)
+	// 上游网卡中途断开时换网卡续传
+	err = CopyWithFailover(ctx, r, bag, span, resp.Body, monitorWriter)
 	if err != nil {
 		select {
 		case <-ctx.Done():
@@ -260,6 +355,9 @@ func (p *NetHTTPClient) ProbeFile(ctx context.Context, targetURL string, r *http
 			return err
 		}
 	}
+	if verifier != nil {
+		return verifier.Finish()
+	}
 	return nil
 }
 
@@ -284,27 +382,29 @@ func ReqH1ToH2Headers(reqHead http.Header) http.Header {
 	//h.Del("Accept-Encoding") // 让上游服务器决定编码
 	return h
 }
-func chunksProbe(w http.ResponseWriter, r *http.Request, bag ChunkBag) {
-	if bag.stateCode == http.StatusPartialContent {
-		fmt.Printf("statuCode: %d\n", bag.stateCode)
-		return
+
+// chunksProbe 尝试进行分块加速；返回false表示加速未能开始（尚未向客户端写入任何内容），调用方按普通流式转发
+func chunksProbe(w http.ResponseWriter, r *http.Request, bag ChunkBag) bool {
+	if bag.stateCode != http.StatusOK {
+		fmt.Printf("Not 200 , statuCode: %d，回退为普通转发\n", bag.stateCode)
+		return false
 	}
-	if bag.stateCode == http.StatusOK {
-		conn, bufrw, err := Hijack(w, bag.AllBytes)
-		if err != nil {
-			fmt.Printf("Hijack Error: %v\n", err)
-			conn.Close()
-			return
-		}
-		err = ChunksDeal(bufrw, r, bag)
-		if err != nil {
-			fmt.Printf("ChunksDeal Error: %v\n", err)
-			conn.Close()
-			return
-		}
-		conn.Close()
-		return
+	DiscoverMirrors(r.Context(), r, &bag)
+	// 先完成分块规划，失败时还没有劫持连接，可以透明回退
+	plan, err := PlanChunks(r.Host, bag.AllBytes, len(bag.Mirrors)+1)
+	if err != nil {
+		fmt.Printf("分块规划失败，回退为普通转发: %v\n", err)
+		return false
 	}
-	fmt.Printf("Not 206 or 200 , statuCode: %d\n", bag.stateCode)
-	return
+	conn, bufrw, err := Hijack(w, bag.Header, bag.AllBytes)
+	if err != nil {
+		fmt.Printf("Hijack Error: %v\n", err)
+		return true
+	}
+	defer conn.Close()
+	// 劫持之后的失败由 ChunksDeal 内部降级为单流
+	if err = ChunksDeal(bufrw, r, bag, plan); err != nil {
+		fmt.Printf("ChunksDeal Error: %v\n", err)
+	}
+	return true
 }
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 网卡健康检查：链路是UP但上不了网的网卡仍会在快照中分到权重，发给它的请求全部失败
+// 主动检查：定时对每张网卡做 HTTP 204 检查 + TCP 连接；被动检查：统计真实请求的连接错误率
+// 不健康的网卡从 ProbeEntries/ChunksEntries 中剔除，连续若干次主动检查成功后重新加入
+// 被认证页面（Captive Portal）拦截的网卡立即剔除，dashboard 给出登录链接，检查通过后立即恢复
+
+const (
+	HealthCheckInterval    = 5 * time.Second
+	HealthCheckTimeout     = 3 * time.Second
+	HealthFailThreshold    = 3   // 连续主动检查失败次数
+	HealthRecoverThreshold = 3   // 恢复所需的连续成功次数
+	PassiveWindow          = 20  // 被动统计最近的请求数
+	PassiveMinSamples      = 8   // 样本不足时不按错误率判定
+	PassiveErrorRate       = 0.6 // 超过该错误率即判为不健康
+)
+
+const (
+	HealthOK     = "healthy"
+	HealthDown   = "unhealthy"
+	HealthPortal = "portal" // 被认证页面（酒店/机场Wi-Fi登录页）拦截
+)
+
+// NICHealth 单张网卡的健康状态
+type NICHealth struct {
+	State     string
+	Reason    string
+	PortalURL string // 认证页面地址，State 为 HealthPortal 时有效
+	Since     time.Time
+	fails     int    // 连续主动检查失败
+	oks       int    // 不健康期间连续主动检查成功
+	recent    []bool // 最近真实请求的结果，true 为失败
+}
+
+type NICHealthManager struct {
+	mu    sync.Mutex
+	cards map[string]*NICHealth
+}
+
+var GloNICHealth = &NICHealthManager{
+	cards: make(map[string]*NICHealth),
+}
+
+func (h *NICHealthManager) getOrCreate(IP string) *NICHealth {
+	hc, ok := h.cards[IP]
+	if !ok {
+		hc = &NICHealth{State: HealthOK, Since: time.Now()}
+		h.cards[IP] = hc
+	}
+	return hc
+}
+
+// Healthy 没有记录的网卡视为健康
+func (h *NICHealthManager) Healthy(IP string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hc, ok := h.cards[IP]
+	return !ok || hc.State == HealthOK
+}
+
+// Status 网卡当前状态的副本，供dashboard展示
+func (h *NICHealthManager) Status(IP string) NICHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hc, ok := h.cards[IP]
+	if !ok {
+		return NICHealth{State: HealthOK}
+	}
+	return NICHealth{State: hc.State, Reason: hc.Reason, PortalURL: hc.PortalURL, Since: hc.Since}
+}
+
+// PortalNIC 访问认证页面所在的Host时返回被拦截的网卡，登录请求必须从该网卡发出
+func (h *NICHealthManager) PortalNIC(host string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for IP, hc := range h.cards {
+		if hc.State != HealthPortal {
+			continue
+		}
+		if u, err := url.Parse(hc.PortalURL); err == nil && strings.EqualFold(u.Hostname(), host) {
+			return IP, true
+		}
+	}
+	return "", false
+}
+
+// Forget 网卡被移除时清除状态
+func (h *NICHealthManager) Forget(IP string) {
+	h.mu.Lock()
+	delete(h.cards, IP)
+	h.mu.Unlock()
+}
+
+// Report 记录一次真实请求的连接结果，上下文取消不计入
+func (h *NICHealthManager) Report(IP string, err error) {
+	if err != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return
+	}
+	h.mu.Lock()
+	hc := h.getOrCreate(IP)
+	if hc.State != HealthOK {
+		h.mu.Unlock()
+		return
+	}
+	hc.recent = append(hc.recent, err != nil)
+	if len(hc.recent) > PassiveWindow {
+		hc.recent = hc.recent[len(hc.recent)-PassiveWindow:]
+	}
+	failed := 0
+	for _, f := range hc.recent {
+		if f {
+			failed++
+		}
+	}
+	evict := len(hc.recent) >= PassiveMinSamples && float64(failed)/float64(len(hc.recent)) > PassiveErrorRate
+	if evict {
+		h.setDown(hc, fmt.Sprintf("请求错误率 %d/%d: %v", failed, len(hc.recent), err))
+	}
+	h.mu.Unlock()
+	if evict {
+		h.evict(IP)
+	}
+}
+
+// activeResult 记录一次主动检查结果；认证页面拦截立即剔除，检查通过后立即恢复
+func (h *NICHealthManager) activeResult(IP string, err error) {
+	h.mu.Lock()
+	hc := h.getOrCreate(IP)
+	evict := false
+	var portal *PortalError
+	if errors.As(err, &portal) {
+		if hc.State != HealthPortal {
+			fmt.Printf("🔒 网卡<%s>被认证页面拦截: %s\n", IP, portal.URL)
+			evict = hc.State == HealthOK
+			h.setDown(hc, err.Error())
+			hc.State = HealthPortal
+		}
+		hc.PortalURL = portal.URL
+	} else if err == nil && hc.State == HealthPortal {
+		hc.State = HealthOK
+		hc.Reason = ""
+		hc.PortalURL = ""
+		hc.Since = time.Now()
+		hc.fails = 0
+		hc.recent = nil
+		fmt.Printf("🔓 网卡<%s>已通过认证，重新加入调度\n", IP)
+	} else if err != nil {
+		hc.oks = 0
+		hc.fails++
+		if hc.State == HealthOK && hc.fails >= HealthFailThreshold {
+			h.setDown(hc, err.Error())
+			evict = true
+		} else if hc.State != HealthOK {
+			hc.Reason = err.Error()
+		}
+	} else {
+		hc.fails = 0
+		if hc.State != HealthOK {
+			hc.oks++
+			if hc.oks >= HealthRecoverThreshold {
+				hc.State = HealthOK
+				hc.Reason = ""
+				hc.Since = time.Now()
+				hc.recent = nil
+				fmt.Printf("💚 网卡<%s>恢复健康，重新加入调度\n", IP)
+			}
+		}
+	}
+	h.mu.Unlock()
+	if evict {
+		h.evict(IP)
+	}
+}
+
+func (h *NICHealthManager) setDown(hc *NICHealth, reason string) {
+	hc.State = HealthDown
+	hc.Reason = reason
+	hc.Since = time.Now()
+	hc.oks = 0
+}
+
+// evict 立即从快照中剔除；所有网卡都不健康时保留原快照，由 PeriodCheck 兜底
+func (h *NICHealthManager) evict(IP string) {
+	fmt.Printf("💔 网卡<%s>不健康，暂停调度\n", IP)
+	if snapshot := withoutIP(NetCardCho.current.Load(), IP); snapshot != nil && len(snapshot.ProbeEntries) > 0 {
+		NetCardCho.dropIP(IP)
+	}
+}
+
+// filterHealthy 只保留健康网卡的样本；一张健康的都没有时全部保留，避免所有请求无处可去
+func filterHealthy(cards []CardSample) []CardSample {
+	var healthy []CardSample
+	for _, card := range cards {
+		if GloNICHealth.Healthy(card.IP) {
+			healthy = append(healthy, card)
+		}
+	}
+	if len(healthy) == 0 {
+		return cards
+	}
+	return healthy
+}
+
+// ========== 主动检查 ==========
+
+// RunHealthChecks 定时对所有网卡并行做主动检查，ctx 结束时退出
+func RunHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		NetCardClient.mu.RLock()
+		IPs := make([]string, 0, len(NetCardClient.Content))
+		for IP := range NetCardClient.Content {
+			IPs = append(IPs, IP)
+		}
+		NetCardClient.mu.RUnlock()
+		var wg sync.WaitGroup
+		for _, IP := range IPs {
+			wg.Add(1)
+			go func(IP string) {
+				defer wg.Done()
+				GloNICHealth.activeResult(IP, checkNIC(ctx, IP))
+			}(IP)
+		}
+		wg.Wait()
+	}
+}
+
+// checkNIC 经网卡建立一次TCP连接，再请求连通性检查地址
+func checkNIC(ctx context.Context, IP string) error {
+	NetworkTester.mu.RLock()
+	config := NetworkTester.config
+	NetworkTester.mu.RUnlock()
+	conf := GloNetCardConfig.CheckCard(IP)
+	checkURL := config.HealthCheckURL
+	if conf.ConnectivityURL != "" {
+		checkURL = conf.ConnectivityURL
+	}
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+
+	// 先做HTTP检查：认证网关通常只放行80端口，TCP检查会先失败而识别不出认证页面
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if err := checkConnectivity(checkURL, conf.ConnectivityBody, resp, body); err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(IP)}, Control: BindControl(IP)}
+	conn, err := NICDialContext(IP, dialer)(ctx, "tcp", net.JoinHostPort(config.TCPPingHost, fmt.Sprint(config.TCPPingPort)))
+	if err != nil {
+		return fmt.Errorf("tcp: %w", err)
+	}
+	conn.Close()
+	return nil
+}
+
+// ========== 认证页面检测 ==========
+
+// PortalError 连通性检查被认证页面拦截
+type PortalError struct {
+	URL string
+}
+
+func (e *PortalError) Error() string {
+	return "captive portal: " + e.URL
+}
+
+var metaRefreshRe = regexp.MustCompile(`(?i)<meta[^>]+http-equiv=["']?refresh["']?[^>]+content=["']?\d+\s*;\s*url=([^"'>\s]+)`)
+
+// checkConnectivity 判断检查结果：expectBody 为空时要求204或没有内容的2xx（部分CDN把204改成了200），否则要求200且包含该内容；
+// 被重定向、meta refresh 跳转或返回了其他页面时视为认证页面拦截
+func checkConnectivity(checkURL string, expectBody string, resp *http.Response, body []byte) error {
+	switch {
+	case expectBody == "" && resp.StatusCode == http.StatusNoContent:
+		return nil
+	case expectBody == "" && resp.StatusCode >= 200 && resp.StatusCode < 300 && len(bytes.TrimSpace(body)) == 0:
+		return nil
+	case expectBody != "" && resp.StatusCode == http.StatusOK && strings.Contains(string(body), expectBody):
+		return nil
+	}
+	if loc := resp.Header.Get("Location"); resp.StatusCode >= 300 && resp.StatusCode < 400 && loc != "" {
+		return &PortalError{URL: resolveRef(checkURL, loc)}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		// 有的认证网关直接返回登录页或用 meta refresh 跳转
+		if m := metaRefreshRe.FindSubmatch(body); m != nil {
+			return &PortalError{URL: resolveRef(checkURL, string(m[1]))}
+		}
+		return &PortalError{URL: checkURL}
+	}
+	return fmt.Errorf("http: %s status %d", checkURL, resp.StatusCode)
+}
+
+// resolveRef 把认证页面给出的跳转地址解析为绝对地址；地址来自不可信的网络，
+// 只接受 http/https，其他（javascript: 等）退回检查地址，避免注入dashboard
+func resolveRef(base string, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	r, err := b.Parse(ref)
+	if err != nil || (r.Scheme != "http" && r.Scheme != "https") || r.Host == "" {
+		return base
+	}
+	return r.String()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 网卡热插拔：运行期间监听网卡/地址变化（Linux 使用 netlink，其他系统定时轮询），
+// 新出现的地址立即创建 Transport 并异步测速，消失的地址立即从调度快照中剔除，
+// 待其上未完成的分块结束（或超时）后关闭连接，PeriodCheck 的下一轮（CheckInterval）重新发布快照
+
+const (
+	HotplugDebounce     = 200 * time.Millisecond // 合并短时间内的多条变化事件
+	HotplugPollInterval = 2 * time.Second        // 无 netlink 时的轮询间隔
+	DrainTimeout        = 30 * time.Second       // 等待被移除网卡上未完成分块的最长时间
+)
+
+var hotplugMu sync.Mutex
+
+// WatchNetCards 启动网卡变化监听，ctx 结束时退出
+func WatchNetCards(ctx context.Context) {
+	events := make(chan struct{}, 1)
+	go watchNetCardEvents(ctx, events)
+	var timer *time.Timer
+	fire := make(chan struct{}, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+			if timer == nil {
+				timer = time.AfterFunc(HotplugDebounce, func() {
+					select {
+					case fire <- struct{}{}:
+					default:
+					}
+				})
+			} else {
+				timer.Reset(HotplugDebounce)
+			}
+		case <-fire:
+			RescanNetCards()
+		}
+	}
+}
+
+// notifyHotplug 非阻塞地投递一次变化事件
+func notifyHotplug(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// pollNetCardEvents 定时触发重新扫描，作为没有事件通知时的兜底
+func pollNetCardEvents(ctx context.Context, events chan<- struct{}) {
+	ticker := time.NewTicker(HotplugPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notifyHotplug(events)
+		}
+	}
+}
+
+// RescanNetCards 重新扫描网卡，与当前已创建客户端的网卡比对后增删
+func RescanNetCards() {
+	hotplugMu.Lock()
+	defer hotplugMu.Unlock()
+	added, removed, kept := diffNetCards(scanNetCards())
+	for _, IP := range removed {
+		removeNetCard(IP)
+	}
+	for _, Info := range added {
+		addNetCard(Info)
+	}
+	// 网卡组成变化后重新检测共享上游（等新网卡测速完成）
+	if len(added) > 0 || len(removed) > 0 {
+		time.AfterFunc(10*time.Second, func() { GloSharedUpstream.Detect(context.Background()) })
+	}
+	// 网卡或网关变化后网络环境可能变了，重新选择配置方案；没有变化时不重复检测（轮询时每个周期都会重新扫描）
+	if gatewayChanged(kept) || len(added) > 0 || len(removed) > 0 {
+		go GloProfiles.AutoSwitch()
+	}
+}
+
+// gatewayChanged 比对保留网卡的默认网关，有变化时更新记录的网卡元数据
+func gatewayChanged(kept []*NetCardInfoPara) bool {
+	NetworkTester.mu.Lock()
+	defer NetworkTester.mu.Unlock()
+	changed := false
+	for _, Info := range kept {
+		if old, ok := NetworkTester.NetCardInfo[Info.IP]; ok && old.Gateway != Info.Gateway {
+			fmt.Printf("🔌 网卡<%s>网关变化: %q -> %q\n", Info.IP, old.Gateway, Info.Gateway)
+			old.NetCardMeta = Info.NetCardMeta
+			changed = true
+		}
+	}
+	return changed
+}
+
+// diffNetCards 与当前已创建客户端的网卡比对，分为新增、消失、保留三类
+func diffNetCards(found map[string]*NetCardInfoPara) (added []*NetCardInfoPara, removed []string, kept []*NetCardInfoPara) {
+	NetCardClient.mu.RLock()
+	defer NetCardClient.mu.RUnlock()
+	for IP := range NetCardClient.Content {
+		if _, ok := found[IP]; !ok {
+			removed = append(removed, IP)
+		}
+	}
+	for IP, Info := range found {
+		if _, ok := NetCardClient.Content[IP]; ok {
+			kept = append(kept, Info)
+		} else {
+			added = append(added, Info)
+		}
+	}
+	return added, removed, kept
+}
+
+// addNetCard 为新网卡创建客户端并异步测速，测速完成前 StandardSpeed 为0，调度器不会分配流量
+func addNetCard(Info *NetCardInfoPara) {
+	fmt.Printf("🔌 发现新网卡: %s (%s)\n", Info.IP, Info.Name)
+	NetworkTester.mu.Lock()
+	NetworkTester.NetCardInfo[Info.IP] = Info
+	NetworkTester.mu.Unlock()
+	TransportPoolCreate(Info.IP)
+	go NetworkTester.SpeedTestCard(Info.IP)
+}
+
+// removeNetCard 立即停止向网卡分配新分块，排空后关闭其连接
+func removeNetCard(IP string) {
+	fmt.Printf("🔌 网卡已移除: %s\n", IP)
+	NetCardCho.dropIP(IP)
+
+	NetCardClient.mu.Lock()
+	clients := NetCardClient.Content[IP]
+	delete(NetCardClient.Content, IP)
+	NetCardClient.mu.Unlock()
+
+	NetCardInfo.mu.Lock()
+	delete(NetCardInfo.Content, IP)
+	NetCardInfo.mu.Unlock()
+
+	NetworkTester.mu.Lock()
+	delete(NetworkTester.NetCardInfo, IP)
+	NetworkTester.mu.Unlock()
+
+	BestChunkSizeRecorder.mu.Lock()
+	delete(BestChunkSizeRecorder.content, IP)
+	BestChunkSizeRecorder.mu.Unlock()
+
+	GloChunkSizer.Forget(IP)
+	GloEdgeTracker.Forget(IP)
+	GloNICHealth.Forget(IP)
+	ForgetSchedulers(IP)
+
+	if clients != nil {
+		go drainNetCard(IP, clients)
+	}
+}
+
+// rebuildNetCard 按当前配置重建网卡的全部连接（分块连接数、DNS、绑定方式等可能已变），保留测速结果，
+// 旧连接上未完成的分块继续完成后关闭
+func rebuildNetCard(Info *NetCardInfoPara) {
+	IP := Info.IP
+	NetworkTester.mu.Lock()
+	if old, ok := NetworkTester.NetCardInfo[IP]; ok {
+		Info.MultiSpeed = old.MultiSpeed
+		Info.TCPPingMs = old.TCPPingMs
+	}
+	NetworkTester.NetCardInfo[IP] = Info
+	NetworkTester.mu.Unlock()
+
+	NetCardInfo.mu.RLock()
+	oldInfo := NetCardInfo.Content[IP]
+	NetCardInfo.mu.RUnlock()
+	NetCardClient.mu.RLock()
+	clients := NetCardClient.Content[IP]
+	NetCardClient.mu.RUnlock()
+
+	GloEdgeTracker.Forget(IP)
+	TransportPoolCreate(IP)
+
+	NetCardInfo.mu.Lock()
+	newInfo := NetCardInfo.Content[IP]
+	sameCount := oldInfo != nil && len(oldInfo.EachClient) == len(newInfo.EachClient)
+	if oldInfo != nil {
+		newInfo.LowAvgSpeed = oldInfo.LowAvgSpeed
+		newInfo.FastestSpeed = oldInfo.FastestSpeed
+		newInfo.StandardSpeed = oldInfo.StandardSpeed
+		newInfo.Time = oldInfo.Time
+	}
+	if sameCount {
+		for i, client := range oldInfo.EachClient {
+			newInfo.EachClient[i].bytesInterval = client.bytesInterval
+		}
+	}
+	NetCardInfo.mu.Unlock()
+	if !sameCount {
+		// 连接数变了，计数按新的连接数重建
+		NetCardBytes.content.Delete(IP)
+		ForgetSchedulers(IP)
+	}
+	if clients != nil {
+		go drainNetCard(IP, clients)
+	}
+}
+
+// drainNetCard 等待网卡上未完成的分块结束（失败的分块会被改派到其他网卡），然后关闭全部连接
+func drainNetCard(IP string, clients *NetCardHTTPClient) {
+	closeAll := func() {
+		clients.ProbeClient.CloseIdleConnections()
+		for _, client := range clients.CommonClient {
+			client.CloseIdleConnections()
+		}
+	}
+	closeAll()
+	deadline := time.Now().Add(DrainTimeout)
+	for time.Now().Before(deadline) {
+		if pendingBytes(IP) == 0 {
+			break
+		}
+		time.Sleep(CheckInterval)
+	}
+	closeAll()
+	// 排空期间网卡又回来了的话保留计数
+	NetCardClient.mu.RLock()
+	_, back := NetCardClient.Content[IP]
+	NetCardClient.mu.RUnlock()
+	if !back {
+		NetCardBytes.content.Delete(IP)
+	}
+}
+
+// pendingBytes 网卡所有分块连接上未完成的字节数
+func pendingBytes(IP string) int64 {
+	val, ok := NetCardBytes.content.Load(IP)
+	if !ok {
+		return 0
+	}
+	counters := val.(*ClientBytes)
+	var total int64
+	for i := range counters.outstanding {
+		total += counters.Outstanding(i)
+	}
+	return total
+}
+
+// dropIP 从所有调度器快照中剔除网卡，不等下一轮 PeriodCheck
+func (p *NetHTTPCho) dropIP(IP string) {
+	p.current.Store(withoutIP(p.current.Load(), IP))
+	p.byScheduler.Range(func(key, value any) bool {
+		p.byScheduler.Store(key, withoutIP(value.(*NetCardHTTPCho), IP))
+		return true
+	})
+}
+
+func withoutIP(snapshot *NetCardHTTPCho, IP string) *NetCardHTTPCho {
+	if snapshot == nil {
+		return nil
+	}
+	out := &NetCardHTTPCho{}
+	for _, Entry := range snapshot.ChunksEntries {
+		if Entry.IP != IP {
+			out.ChunksEntries = append(out.ChunksEntries, Entry)
+			out.TotalChunks += Entry.ProbNum
+		}
+	}
+	for _, Entry := range snapshot.ProbeEntries {
+		if Entry.IP != IP {
+			out.ProbeEntries = append(out.ProbeEntries, Entry)
+			out.TotalProbe += Entry.ProbNum
+		}
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// rtnetlink 多播组（syscall 包中没有定义）
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+
+	netlinkReadTimeout = time.Second // 读取超时，超时后检查是否需要退出
+)
+
+// watchNetCardEvents 订阅 netlink 的链路与地址变化，任何变化都触发一次重新扫描
+func watchNetCardEvents(ctx context.Context, events chan<- struct{}) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		fmt.Printf("netlink不可用，改为轮询: %v\n", err)
+		pollNetCardEvents(ctx, events)
+		return
+	}
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		fmt.Printf("netlink绑定失败，改为轮询: %v\n", err)
+		pollNetCardEvents(ctx, events)
+		return
+	}
+	defer syscall.Close(fd)
+	// 设置读取超时，每次超时检查 ctx，不在其他goroutine中关闭仍在读取的套接字
+	tv := syscall.NsecToTimeval(netlinkReadTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		fmt.Printf("netlink设置超时失败，改为轮询: %v\n", err)
+		pollNetCardEvents(ctx, events)
+		return
+	}
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			switch err {
+			case syscall.EAGAIN, syscall.EINTR:
+				continue
+			case syscall.ENOBUFS:
+				// 缓冲区溢出说明丢了事件，直接重新扫描
+				notifyHotplug(events)
+				continue
+			}
+			fmt.Printf("netlink读取失败，改为轮询: %v\n", err)
+			pollNetCardEvents(ctx, events)
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case syscall.RTM_NEWLINK, syscall.RTM_DELLINK, syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+				notifyHotplug(events)
+			}
+		}
+	}
+}
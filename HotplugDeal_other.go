@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// watchNetCardEvents 没有 netlink 的系统上定时轮询
+func watchNetCardEvents(ctx context.Context, events chan<- struct{}) {
+	pollNetCardEvents(ctx, events)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 完整性校验：对按序交付给客户端的字节流做流式哈希，在释放最后一段数据之前与期望值比对
+// 期望值来源：registry digest、Digest / Repr-Digest / Content-Digest / Content-MD5 响应头、同目录的 .sha256/.md5 校验文件
+
+const (
+	HoldBackSize     = 1 * 1024 * 1024 // 校验通过前扣留的末尾字节数
+	SidecarWait      = 10 * time.Second
+	IntegrityLogPath = "./Cache/IntegrityFailures.log"
+)
+
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// ExpectedDigest 一条期望摘要
+type ExpectedDigest struct {
+	Algo   string // sha256 / sha512 / sha1 / md5
+	Value  []byte
+	Source string // 期望值来源，便于日志定位
+}
+
+// IntegrityChecker 同时计算所有需要的算法，Verify 时逐条比对
+type IntegrityChecker struct {
+	hashes   map[string]hash.Hash
+	writer   io.Writer
+	expected []ExpectedDigest
+	sidecar  <-chan []ExpectedDigest
+}
+
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// NewIntegrityChecker 根据bag中的摘要和源站响应头构建校验器；sidecar 非nil时异步等待校验文件结果
+// 没有任何期望值时返回nil
+func NewIntegrityChecker(bag ChunkBag, sidecar <-chan []ExpectedDigest) *IntegrityChecker {
+	var expected []ExpectedDigest
+	if bag.Digest != "" {
+		if d, ok := parseOCIDigest(bag.Digest); ok {
+			expected = append(expected, d)
+		}
+	}
+	expected = append(expected, DigestsFromResponse(bag.Header, bag.HeaderStatus)...)
+	if len(expected) == 0 && sidecar == nil {
+		return nil
+	}
+	c := &IntegrityChecker{hashes: make(map[string]hash.Hash), expected: expected, sidecar: sidecar}
+	algos := []string{}
+	for _, d := range expected {
+		algos = append(algos, d.Algo)
+	}
+	// 校验文件的算法事先未知，两种都算
+	if sidecar != nil {
+		algos = append(algos, "sha256", "md5")
+	}
+	var writers []io.Writer
+	for _, algo := range algos {
+		if _, ok := c.hashes[algo]; ok {
+			continue
+		}
+		if h := newHash(algo); h != nil {
+			c.hashes[algo] = h
+			writers = append(writers, h)
+		}
+	}
+	c.writer = io.MultiWriter(writers...)
+	return c
+}
+
+func (c *IntegrityChecker) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// Verify 比对所有期望值；没有任何可用期望值时视为通过
+func (c *IntegrityChecker) Verify() error {
+	expected := c.expected
+	if c.sidecar != nil {
+		select {
+		case extra := <-c.sidecar:
+			expected = append(expected, extra...)
+		case <-time.After(SidecarWait):
+			fmt.Printf("⚠️ 等待校验文件超时，跳过\n")
+		}
+	}
+	for _, d := range expected {
+		h, ok := c.hashes[d.Algo]
+		if !ok {
+			continue
+		}
+		if got := h.Sum(nil); !bytes.Equal(got, d.Value) {
+			return fmt.Errorf("%w: %s from %s want %x, got %x", ErrDigestMismatch, d.Algo, d.Source, d.Value, got)
+		}
+	}
+	return nil
+}
+
+// ========== 普通转发的校验 ==========
+
+// VerifyingWriter 普通转发（未分块）时对写给客户端的字节流做哈希，始终扣留末尾 HoldBackSize 字节，Finish 校验通过后才释放
+// 响应长度可能未知，所以扣留的是滚动的末尾，而不是按总大小计算
+type VerifyingWriter struct {
+	http.ResponseWriter
+	checker *IntegrityChecker
+	held    []byte
+	origin  string
+}
+
+// NewVerifyingWriter 只在有期望摘要（如registry镜像层的digest）时校验，否则返回nil
+func NewVerifyingWriter(w http.ResponseWriter, bag ChunkBag) *VerifyingWriter {
+	if bag.Digest == "" {
+		return nil
+	}
+	checker := NewIntegrityChecker(bag, nil)
+	if checker == nil {
+		return nil
+	}
+	return &VerifyingWriter{ResponseWriter: w, checker: checker, origin: bag.OriginURL()}
+}
+
+func (v *VerifyingWriter) Write(p []byte) (int, error) {
+	v.checker.Write(p)
+	v.held = append(v.held, p...)
+	// 扣留超过两倍时才写出，避免每次写入都搬移扣留的数据
+	if over := len(v.held) - HoldBackSize; over >= HoldBackSize {
+		if _, err := v.ResponseWriter.Write(v.held[:over]); err != nil {
+			return 0, err
+		}
+		v.held = append(v.held[:0], v.held[over:]...)
+	}
+	return len(p), nil
+}
+
+// Finish 校验摘要并释放扣留的末尾数据；校验失败时不释放，调用方中止连接让客户端丢弃该文件
+func (v *VerifyingWriter) Finish() error {
+	if err := v.checker.Verify(); err != nil {
+		fmt.Printf("❌ 完整性校验失败，中止连接: %v\n", err)
+		RecordIntegrityFailure(v.origin, err)
+		return err
+	}
+	_, err := v.ResponseWriter.Write(v.held)
+	v.held = nil
+	return err
+}
+
+// ========== 期望值解析 ==========
+
+// normalizeAlgo 统一各种写法：SHA-256 / sha-256 / sha256
+func normalizeAlgo(algo string) string {
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	return strings.ReplaceAll(algo, "-", "")
+}
+
+func parseOCIDigest(digest string) (ExpectedDigest, bool) {
+	algo, value, ok := strings.Cut(digest, ":")
+	if !ok {
+		return ExpectedDigest{}, false
+	}
+	algo = normalizeAlgo(algo)
+	raw, err := hex.DecodeString(value)
+	if err != nil || newHash(algo) == nil || len(raw) != newHash(algo).Size() {
+		return ExpectedDigest{}, false
+	}
+	return ExpectedDigest{Algo: algo, Value: raw, Source: "digest " + digest}, true
+}
+
+// DigestsFromHeader 解析 Digest(RFC 3230)、Repr-Digest/Content-Digest(RFC 9530)、Content-MD5
+func DigestsFromHeader(h http.Header) []ExpectedDigest {
+	return digestsFromHeader(h, false)
+}
+
+// ReprDigestsFromHeader 只解析针对整个表示的 Digest、Repr-Digest，不受 Range 影响
+func ReprDigestsFromHeader(h http.Header) []ExpectedDigest {
+	return digestsFromHeader(h, true)
+}
+
+// DigestsFromResponse 206 响应的 Content-Digest、Content-MD5 只针对返回的部分，不能用来校验完整文件
+func DigestsFromResponse(h http.Header, status int) []ExpectedDigest {
+	if status == http.StatusPartialContent {
+		return ReprDigestsFromHeader(h)
+	}
+	return DigestsFromHeader(h)
+}
+
+func digestsFromHeader(h http.Header, reprOnly bool) []ExpectedDigest {
+	var out []ExpectedDigest
+	add := func(algo string, b64 string, source string) {
+		algo = normalizeAlgo(algo)
+		hf := newHash(algo)
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if hf == nil || err != nil || len(raw) != hf.Size() {
+			return
+		}
+		out = append(out, ExpectedDigest{Algo: algo, Value: raw, Source: source})
+	}
+	if h == nil {
+		return nil
+	}
+	// Digest: SHA-256=<base64>, MD5=<base64>
+	for _, v := range h.Values("Digest") {
+		for _, item := range strings.Split(v, ",") {
+			if algo, value, ok := strings.Cut(item, "="); ok {
+				add(algo, value, "Digest")
+			}
+		}
+	}
+	// Repr-Digest / Content-Digest: sha-256=:<base64>:
+	names := []string{"Repr-Digest", "Content-Digest"}
+	if reprOnly {
+		names = names[:1]
+	}
+	for _, name := range names {
+		for _, v := range h.Values(name) {
+			for _, item := range strings.Split(v, ",") {
+				if algo, value, ok := strings.Cut(item, "="); ok {
+					add(algo, strings.Trim(strings.TrimSpace(value), ":"), name)
+				}
+			}
+		}
+	}
+	if v := h.Get("Content-MD5"); v != "" && !reprOnly {
+		add("md5", v, "Content-MD5")
+	}
+	return out
+}
+
+// ========== 同目录校验文件 ==========
+
+// FetchSidecar 异步获取 <文件>.sha256 / <文件>.md5，取第一个可用的
+func FetchSidecar(ctx context.Context, fileURL string, Headers http.Header) <-chan []ExpectedDigest {
+	ch := make(chan []ExpectedDigest, 1)
+	go func() {
+		var found []ExpectedDigest
+		for _, ext := range []string{".sha256", ".md5"} {
+			if d, ok := fetchOneSidecar(ctx, fileURL, ext, Headers); ok {
+				found = append(found, d)
+				break
+			}
+		}
+		ch <- found
+	}()
+	return ch
+}
+
+func fetchOneSidecar(ctx context.Context, fileURL string, ext string, Headers http.Header) (ExpectedDigest, bool) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return ExpectedDigest{}, false
+	}
+	// 校验文件与原文件同目录，不带签名参数
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.Path += ext
+	IP, err := NetCardCho.getBestProbeIP()
+	if err != nil {
+		return ExpectedDigest{}, false
+	}
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return ExpectedDigest{}, false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return ExpectedDigest{}, false
+	}
+	req.Header = ReqH1ToH2Headers(Headers.Clone())
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	resp, err := client.Do(req)
+	if err != nil {
+		return ExpectedDigest{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ExpectedDigest{}, false
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return ExpectedDigest{}, false
+	}
+	// 常见格式："<hex>  filename" 或只有 "<hex>"
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return ExpectedDigest{}, false
+	}
+	algo := strings.TrimPrefix(ext, ".")
+	raw, err := hex.DecodeString(fields[0])
+	if err != nil || len(raw) != newHash(algo).Size() {
+		return ExpectedDigest{}, false
+	}
+	return ExpectedDigest{Algo: algo, Value: raw, Source: u.String()}, true
+}
+
+// ========== 失败记录 ==========
+
+// RecordIntegrityFailure 记录校验失败，并清除该URL的大小缓存，下次重新探测
+func RecordIntegrityFailure(targetURL string, cause error) {
+	GloFileSizeCache.Cache.Delete(targetURL)
+	GloCodeCache.Cache.Delete(targetURL)
+	if err := os.MkdirAll(filepath.Dir(IntegrityLogPath), 0o755); err != nil {
+		fmt.Printf("创建目录失败: %v\n", err)
+		return
+	}
+	f, err := os.OpenFile(IntegrityLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		fmt.Printf("写入文件失败: %v\n", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\t%s\t%v\n", time.Now().Format(time.RFC3339), targetURL, cause)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// 网卡筛选与元数据：默认会把 docker0、virbr0、tailscale0、VPN隧道等虚拟网卡也拿去测速和调度
+// NetCardConfig.json 中 Include/Exclude 按网卡名通配符、类型、网段筛选；未配置 Exclude 时使用内置的虚拟网卡排除规则
+
+const (
+	KindEthernet = "ethernet"
+	KindWifi     = "wifi"
+	KindTun      = "tun"     // VPN/隧道等点对点网卡
+	KindVirtual  = "virtual" // 网桥、veth、虚拟机网卡等
+)
+
+// NetCardMeta 网卡元数据
+type NetCardMeta struct {
+	Name    string   `json:"name"`
+	MAC     string   `json:"mac"`
+	MTU     int      `json:"mtu"`
+	Gateway string   `json:"gateway"`
+	Kind    string   `json:"kind"`
+	Addrs   []string `json:"addrs"` // 网卡上的全部地址（CIDR）
+}
+
+// InterfaceRule 网卡匹配规则，所有非空字段都满足才算匹配
+type InterfaceRule struct {
+	Name   string `json:"Name"`   // 网卡名通配符，如 "docker*"
+	Kind   string `json:"Kind"`   // ethernet / wifi / tun / virtual
+	Subnet string `json:"Subnet"` // 网卡任一地址落在该网段内，如 "172.16.0.0/12"
+}
+
+// DefaultExcludeRules 未配置 Exclude 时排除的常见虚拟网卡与隧道
+// 不按 KindVirtual 排除：容器里唯一的出口网卡就是 veth
+var DefaultExcludeRules = []InterfaceRule{
+	{Name: "docker*"}, {Name: "br-*"}, {Name: "veth*"}, {Name: "virbr*"},
+	{Name: "vmnet*"}, {Name: "VMware*"}, {Name: "vEthernet*"}, {Name: "VirtualBox*"},
+	{Kind: KindTun},
+}
+
+// isDialUp PPPoE 拨号虽然是点对点网卡，但它就是真实的上行链路
+func isDialUp(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "ppp") || strings.Contains(name, "broadband") || strings.Contains(name, "宽带")
+}
+
+// Match 判断网卡是否满足规则
+func (r InterfaceRule) Match(meta NetCardMeta) bool {
+	if r.Name == "" && r.Kind == "" && r.Subnet == "" {
+		return false
+	}
+	if r.Name != "" {
+		if ok, _ := filepath.Match(r.Name, meta.Name); !ok {
+			return false
+		}
+	}
+	if r.Kind != "" && !strings.EqualFold(r.Kind, meta.Kind) {
+		return false
+	}
+	if r.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(r.Subnet)
+		if err != nil {
+			return false
+		}
+		inside := false
+		for _, addr := range meta.Addrs {
+			if IP, _, err := net.ParseCIDR(addr); err == nil && subnet.Contains(IP) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return false
+		}
+	}
+	return true
+}
+
+// InterfaceAllowed 配置了 Include 时必须匹配其一，再排除匹配 Exclude 的网卡
+func (m *NetCardConfigManager) InterfaceAllowed(meta NetCardMeta) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.include) > 0 {
+		matched := false
+		for _, rule := range m.include {
+			if rule.Match(meta) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	exclude := m.exclude
+	if exclude == nil {
+		exclude = DefaultExcludeRules
+	}
+	for _, rule := range exclude {
+		if rule.Match(meta) {
+			return false
+		}
+	}
+	return true
+}
+
+// describeInterface 收集网卡元数据
+func describeInterface(iface net.Interface, gateways map[string]string) NetCardMeta {
+	meta := NetCardMeta{
+		Name:    iface.Name,
+		MAC:     iface.HardwareAddr.String(),
+		MTU:     iface.MTU,
+		Gateway: gateways[iface.Name],
+		Kind:    interfaceKind(iface),
+	}
+	if addrs, err := iface.Addrs(); err == nil {
+		for _, addr := range addrs {
+			meta.Addrs = append(meta.Addrs, addr.String())
+		}
+	}
+	return meta
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// interfaceKind 依据 /sys/class/net 判断网卡类型
+func interfaceKind(iface net.Interface) string {
+	dir := filepath.Join("/sys/class/net", iface.Name)
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	switch {
+	case exists("wireless") || exists("phy80211"):
+		return KindWifi
+	case isDialUp(iface.Name):
+		return KindEthernet
+	case exists("tun_flags") || iface.Flags&net.FlagPointToPoint != 0 || len(iface.HardwareAddr) == 0:
+		return KindTun
+	case exists("bridge") || !exists("device"):
+		// 没有对应物理设备的网卡：网桥、veth、dummy 等
+		return KindVirtual
+	}
+	return KindEthernet
+}
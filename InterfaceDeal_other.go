@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// interfaceKind 没有 sysfs 时按标志位与网卡名判断
+func interfaceKind(iface net.Interface) string {
+	name := strings.ToLower(iface.Name)
+	switch {
+	case isDialUp(iface.Name):
+		return KindEthernet
+	case iface.Flags&net.FlagPointToPoint != 0 || len(iface.HardwareAddr) == 0:
+		return KindTun
+	case strings.Contains(name, "wi-fi") || strings.Contains(name, "wlan") || strings.Contains(name, "wireless"):
+		return KindWifi
+	case strings.Contains(name, "vethernet") || strings.Contains(name, "virtual") || strings.Contains(name, "vmware"):
+		return KindVirtual
+	}
+	return KindEthernet
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 多镜像下载：同一个文件的分块可以分散到多个镜像源，镜像来源：
+// 1. 响应头 Link: <url>; rel=duplicate (RFC 6249)
+// 2. 响应头 Link: <url>; rel=describedby; type="application/metalink4+xml" 指向的Metalink文件 (RFC 5854)
+// 3. 策略文件中该Host的 Mirrors 列表
+// 镜像在使用前都要用 Range: bytes=0-0 确认大小一致、摘要不冲突
+
+const (
+	MaxMirrors      = 8
+	MirrorProbeWait = 3 * time.Second
+	MetalinkMaxSize = 1 * 1024 * 1024
+	MetalinkType    = "application/metalink4+xml"
+)
+
+// Mirror 已通过校验的镜像，记录它自己的校验值用于 If-Range
+type Mirror struct {
+	URL          string
+	ETag         string
+	LastModified string
+	Source       string // duplicate / metalink / policy
+}
+
+// ForMirror 返回分块实际使用的源：0 为源站（含重定向固定地址），i>0 为 bag.Mirrors[i-1]
+func (b ChunkBag) ForMirror(i int) ChunkBag {
+	if i <= 0 || i > len(b.Mirrors) {
+		return b
+	}
+	m := b.Mirrors[i-1]
+	src := b
+	src.TargetURL = m.URL
+	src.Pin = nil
+	src.ETag = m.ETag
+	src.LastModified = m.LastModified
+	return src
+}
+
+// AssignMirrors 按网卡轮转镜像，让分块均匀分布到每个 (网卡, 镜像) 组合上
+func AssignMirrors(tasks []ChunkTask, sources int) {
+	if sources <= 1 {
+		return
+	}
+	counter := make(map[string]int)
+	for i := range tasks {
+		IP := tasks[i].ClientIP
+		tasks[i].Mirror = counter[IP] % sources
+		counter[IP]++
+	}
+}
+
+// ========== 1. 收集候选镜像 ==========
+
+type linkValue struct {
+	URL    string
+	Rel    string
+	Type   string
+	Pri    int
+	hasPri bool
+}
+
+// parseLinkHeader 解析 Link 头：<url>; rel=duplicate; pri=1, <url2>; rel="describedby"; type="..."
+func parseLinkHeader(values []string, base *url.URL) []linkValue {
+	var links []linkValue
+	for _, v := range values {
+		for _, part := range splitLinks(v) {
+			part = strings.TrimSpace(part)
+			if !strings.HasPrefix(part, "<") {
+				continue
+			}
+			// 没有闭合的 < 会把后面的link吞进地址里，地址中出现空白或 < 时整段丢弃
+			end := strings.Index(part, ">")
+			if end < 0 || strings.ContainsAny(part[1:end], " \t<") {
+				continue
+			}
+			ref, err := url.Parse(part[1:end])
+			if err != nil {
+				continue
+			}
+			if base != nil {
+				ref = base.ResolveReference(ref)
+			}
+			link := linkValue{URL: ref.String()}
+			for _, param := range strings.Split(part[end+1:], ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok {
+					continue
+				}
+				value = strings.Trim(strings.TrimSpace(value), `"`)
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "rel":
+					link.Rel = strings.ToLower(value)
+				case "type":
+					link.Type = strings.ToLower(value)
+				case "pri":
+					if n, err := strconv.Atoi(value); err == nil {
+						link.Pri = n
+						link.hasPri = true
+					}
+				}
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// splitLinks 按逗号分割多个link，忽略 <> 与引号内的逗号
+func splitLinks(v string) []string {
+	var parts []string
+	depth, quoted, start := 0, false, 0
+	for i, c := range v {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '<' && !quoted:
+			depth++
+		case c == '>' && !quoted:
+			depth--
+		case c == ',' && !quoted && depth == 0:
+			parts = append(parts, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, v[start:])
+}
+
+// metalink4 RFC 5854 中用到的部分
+type metalink4 struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Size   int64  `xml:"size"`
+		Hashes []struct {
+			Type  string `xml:"type,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"hash"`
+		URLs []struct {
+			Priority int    `xml:"priority,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"url"`
+	} `xml:"file"`
+}
+
+// fetchMetalink 下载并解析Metalink，返回镜像地址（按priority排序）和文件的sha256摘要
+func fetchMetalink(ctx context.Context, client *http.Client, metaURL string, fileURL string, Headers http.Header) ([]string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metaURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	to, _ := url.Parse(metaURL)
+	from, _ := url.Parse(fileURL)
+	if to != nil && from != nil {
+		req.Header = redirectHeaders(Headers, from, to)
+	}
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	req.Header.Set("Accept", MetalinkType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("metalink status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MetalinkMaxSize))
+	if err != nil {
+		return nil, "", err
+	}
+	var doc metalink4
+	if err = xml.Unmarshal(data, &doc); err != nil {
+		return nil, "", err
+	}
+	if len(doc.Files) == 0 {
+		return nil, "", fmt.Errorf("metalink without file")
+	}
+	// 多文件时按文件名匹配
+	file := doc.Files[0]
+	if from != nil {
+		for _, f := range doc.Files {
+			if f.Name == path.Base(from.Path) {
+				file = f
+				break
+			}
+		}
+	}
+	sort.SliceStable(file.URLs, func(i, j int) bool { return file.URLs[i].Priority < file.URLs[j].Priority })
+	var mirrors []string
+	for _, u := range file.URLs {
+		if v := strings.TrimSpace(u.Value); v != "" {
+			mirrors = append(mirrors, v)
+		}
+	}
+	digest := ""
+	for _, h := range file.Hashes {
+		if normalizeAlgo(h.Type) == "sha256" {
+			digest = "sha256:" + strings.ToLower(strings.TrimSpace(h.Value))
+		}
+	}
+	return mirrors, digest, nil
+}
+
+// policyMirrors 策略文件中的镜像是基础地址，拼上原始请求路径（不带查询参数，签名通常只对源站有效）
+func policyMirrors(host string, fileURL string) []string {
+	bases := GlobalPolicyManager.CheckRule(host).Mirrors
+	if len(bases) == 0 {
+		return nil
+	}
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return nil
+	}
+	var mirrors []string
+	for _, base := range bases {
+		mirrors = append(mirrors, strings.TrimRight(base, "/")+u.EscapedPath())
+	}
+	return mirrors
+}
+
+// ========== 2. 校验镜像并写入bag ==========
+
+// DiscoverMirrors 收集并校验镜像，结果写入 bag.Mirrors；Metalink 提供的 sha256 在没有其他摘要时作为完整性校验依据
+func DiscoverMirrors(ctx context.Context, r *http.Request, bag *ChunkBag) {
+	IP, err := NetCardCho.getBestProbeIP()
+	if err != nil {
+		return
+	}
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, MirrorProbeWait)
+	defer cancel()
+
+	fileURL := bag.URL()
+	base, _ := url.Parse(fileURL)
+	var candidates []string
+	sources := make(map[string]string)
+	add := func(u string, source string) {
+		if _, ok := sources[u]; ok || u == fileURL || u == bag.OriginURL() {
+			return
+		}
+		sources[u] = source
+		candidates = append(candidates, u)
+	}
+
+	links := parseLinkHeader(bag.Header.Values("Link"), base)
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].hasPri && (!links[j].hasPri || links[i].Pri < links[j].Pri)
+	})
+	for _, link := range links {
+		if hasRel(link.Rel, "duplicate") {
+			add(link.URL, "duplicate")
+		}
+	}
+	for _, link := range links {
+		if !hasRel(link.Rel, "describedby") || link.Type != MetalinkType {
+			continue
+		}
+		mirrors, digest, err := fetchMetalink(ctx, client, link.URL, fileURL, r.Header)
+		if err != nil {
+			fmt.Printf("⚠️ Metalink获取失败 %s: %v\n", link.URL, err)
+			continue
+		}
+		for _, m := range mirrors {
+			add(m, "metalink")
+		}
+		if bag.Digest == "" && digest != "" {
+			bag.Digest = digest
+		}
+		break
+	}
+	for _, m := range policyMirrors(r.Host, bag.OriginURL()) {
+		add(m, "policy")
+	}
+	if len(candidates) > MaxMirrors {
+		candidates = candidates[:MaxMirrors]
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	verified := make(map[string]Mirror)
+	for _, candidate := range candidates {
+		wg.Add(1)
+		go func(candidate string) {
+			defer wg.Done()
+			m, err := verifyMirror(ctx, client, candidate, *bag, r.Header)
+			if err != nil {
+				fmt.Printf("⚠️ 镜像不可用 %s: %v\n", candidate, err)
+				return
+			}
+			m.Source = sources[candidate]
+			mu.Lock()
+			verified[candidate] = m
+			mu.Unlock()
+		}(candidate)
+	}
+	wg.Wait()
+	// 保持候选顺序（优先级）
+	for _, candidate := range candidates {
+		if m, ok := verified[candidate]; ok {
+			bag.Mirrors = append(bag.Mirrors, m)
+		}
+	}
+	if len(bag.Mirrors) > 0 {
+		fmt.Printf("🪞 可用镜像 %d 个: %v\n", len(bag.Mirrors), bag.Mirrors)
+	}
+}
+
+func hasRel(rel string, want string) bool {
+	for _, r := range strings.Fields(rel) {
+		if r == want {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyMirror 确认镜像支持Range、总大小与源站一致、两边都给出的表示摘要一致、镜像的文件不比源站旧
+// ETag 通常是各服务器自己生成的，不要求跨镜像一致，只用于该镜像后续分块的 If-Range
+// 镜像的探测响应是206，其 Content-Digest、Content-MD5 只针对返回的1个字节，只比较 Repr-Digest、Digest
+func verifyMirror(ctx context.Context, client *http.Client, mirrorURL string, bag ChunkBag, Headers http.Header) (Mirror, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mirrorURL, nil)
+	if err != nil {
+		return Mirror{}, err
+	}
+	req.Header = pinnedHeaders(Headers, bag, mirrorURL)
+	req.Header.Del("If-Range")
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return Mirror{}, err
+	}
+	defer resp.Body.Close()
+	// 镜像自己也可能重定向，固定到最终地址
+	if isRedirectStatus(resp.StatusCode) {
+		final, err := FollowRedirects(ctx, client, resp, req.Header)
+		if err != nil {
+			return Mirror{}, err
+		}
+		resp = final
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return Mirror{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	_, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || total != bag.AllBytes {
+		return Mirror{}, fmt.Errorf("size %d, want %d", total, bag.AllBytes)
+	}
+	mirrorDigests := ReprDigestsFromHeader(resp.Header)
+	if err = digestsAgree(DigestsFromResponse(bag.Header, bag.HeaderStatus), mirrorDigests); err != nil {
+		return Mirror{}, err
+	}
+	if originTime, err := http.ParseTime(bag.LastModified); err == nil {
+		if mirrorTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && mirrorTime.Before(originTime) {
+			return Mirror{}, fmt.Errorf("stale: last modified %s, origin %s", resp.Header.Get("Last-Modified"), bag.LastModified)
+		}
+	}
+	if bag.Digest != "" {
+		if want, ok := parseOCIDigest(bag.Digest); ok {
+			if err = digestsAgree([]ExpectedDigest{want}, mirrorDigests); err != nil {
+				return Mirror{}, err
+			}
+		}
+	}
+	m := Mirror{URL: resp.Request.URL.String(), LastModified: resp.Header.Get("Last-Modified")}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		m.ETag = etag
+	}
+	return m, nil
+}
+
+// digestsAgree 相同算法的摘要必须一致
+func digestsAgree(a []ExpectedDigest, b []ExpectedDigest) error {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Algo == y.Algo && !bytes.Equal(x.Value, y.Value) {
+				return fmt.Errorf("%s differs: %s from %s, %s from %s", x.Algo,
+					hex.EncodeToString(x.Value), x.Source, hex.EncodeToString(y.Value), y.Source)
+			}
+		}
+	}
+	return nil
+}
+
+// NextMirror 分块失败后换到下一个来源（源站与各镜像轮转）
+func (b ChunkBag) NextMirror(i int) int {
+	if len(b.Mirrors) == 0 {
+		return 0
+	}
+	return (i + 1) % (len(b.Mirrors) + 1)
+}
+
+// mirrorErr 镜像返回的内容不合规只说明该镜像不可用，改为可重试（换源），不触发整个任务的降级
+func mirrorErr(task ChunkTask, usedURL string, err error) error {
+	if task.Mirror > 0 && errors.Is(err, ErrChunkMismatch) {
+		return fmt.Errorf("retryable: mirror %s: %v", usedURL, err)
+	}
+	return err
+}
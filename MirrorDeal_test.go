@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseLinkHeader(t *testing.T) {
+	base, _ := url.Parse("https://example.com/files/app.iso")
+	tests := []struct {
+		name   string
+		values []string
+		want   []linkValue
+	}{
+		{
+			"duplicate with pri",
+			[]string{`<https://m1.example.net/app.iso>; rel=duplicate; pri=1`},
+			[]linkValue{{URL: "https://m1.example.net/app.iso", Rel: "duplicate", Pri: 1, hasPri: true}},
+		},
+		{
+			"multiple links",
+			[]string{`<https://m1.example.net/app.iso>; rel=duplicate; pri=2, <https://m2.example.net/app.iso>; rel="Duplicate"`},
+			[]linkValue{
+				{URL: "https://m1.example.net/app.iso", Rel: "duplicate", Pri: 2, hasPri: true},
+				{URL: "https://m2.example.net/app.iso", Rel: "duplicate"},
+			},
+		},
+		{
+			"quoted comma",
+			[]string{`<https://m1.example.net/app.iso.meta4>; rel=describedby; type="application/metalink4+xml"; title="a, b", <https://m2.example.net/app.iso>; rel=duplicate`},
+			[]linkValue{
+				{URL: "https://m1.example.net/app.iso.meta4", Rel: "describedby", Type: "application/metalink4+xml"},
+				{URL: "https://m2.example.net/app.iso", Rel: "duplicate"},
+			},
+		},
+		{
+			"comma inside url",
+			[]string{`<https://m1.example.net/a,b.iso>; rel=duplicate`},
+			[]linkValue{{URL: "https://m1.example.net/a,b.iso", Rel: "duplicate"}},
+		},
+		{
+			"relative url",
+			[]string{`</mirror/app.iso>; rel=duplicate`},
+			[]linkValue{{URL: "https://example.com/mirror/app.iso", Rel: "duplicate"}},
+		},
+		{
+			"several header values",
+			[]string{`<https://m1.example.net/app.iso>; rel=duplicate`, `<https://m2.example.net/app.iso>; rel=duplicate; pri=x`},
+			[]linkValue{
+				{URL: "https://m1.example.net/app.iso", Rel: "duplicate"},
+				{URL: "https://m2.example.net/app.iso", Rel: "duplicate"},
+			},
+		},
+		{
+			"malformed skipped",
+			[]string{
+				`https://m1.example.net/app.iso; rel=duplicate`,
+				`<https://m2.example.net/app.iso; rel=duplicate, <https://m3.example.net/app.iso>`,
+				`, , <https://m4.example.net/app.iso>`,
+			},
+			[]linkValue{{URL: "https://m4.example.net/app.iso"}},
+		},
+		{"empty", []string{""}, nil},
+	}
+	for _, tt := range tests {
+		if got := parseLinkHeader(tt.values, base); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseLinkHeader = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitLinks(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`<a>, <b>`, []string{`<a>`, ` <b>`}},
+		{`<a,b>; title="x, y", <c>`, []string{`<a,b>; title="x, y"`, ` <c>`}},
+		{`<a>`, []string{`<a>`}},
+	}
+	for _, tt := range tests {
+		if got := splitLinks(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitLinks(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -8,6 +8,8 @@ func NetCardCLI() {
 	NetworkTester.DefaultTestConfig()
 	// 网卡参数加载
 	InitNetCardInfo()
+	// 检查多张网卡是否实际走了同一出口
+	DiagnoseEgress()
 	// Client绑定性加载 以及 Cho的基本初始化
 	IPHTTPClientAndChoInit()
 	// 进行TCP测试
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// 网卡级配置（NetCardConfig.json），按网卡IP或网卡名配置，"*" 为所有网卡的默认值
+// 文件不存在时全部使用默认行为
+
+type NetCardConf struct {
+	ClientComNum int      `json:"ClientComNum"` // 分块连接数，<=0 时使用默认的 ClientComNum
+	DNS          []string `json:"DNS"`          // 经该网卡查询的DNS服务器，"IP" 或 "IP:端口"，为空时使用系统解析
+	DNSOverTCP   bool     `json:"DNSOverTCP"`   // 直接使用TCP查询（默认UDP，被截断时自动改用TCP）
+	DoH          string   `json:"DoH"`          // DNS-over-HTTPS 地址，设置后优先于 DNS
+	BindDevice   bool     `json:"BindDevice"`   // 使用 SO_BINDTODEVICE 绑定到网卡（仅Linux）
+
+	ConnectivityURL  string `json:"ConnectivityURL"`  // 连通性检查地址，为空时使用默认的 HealthCheckURL
+	ConnectivityBody string `json:"ConnectivityBody"` // 期望的响应内容，为空时要求返回204
+
+	// 按流量计费的链路
+	CostWeight   float64 `json:"CostWeight"`   // 流量成本权重，>1 时按比例降低调度权重，<=1 视为不计费
+	DailyQuota   int64   `json:"DailyQuota"`   // 每日流量上限（字节），0 为不限
+	MonthlyQuota int64   `json:"MonthlyQuota"` // 每个计费周期的流量上限（字节），0 为不限
+	BillingDay   int     `json:"BillingDay"`   // 计费周期起始日 1-28，默认1
+
+	Schedule []NICScheduleRule `json:"Schedule"` // 分时规则，按顺序匹配第一条，没有匹配时正常参与调度
+}
+
+type NetCardConfigFile struct {
+	Cards          map[string]NetCardConf `json:"Cards"`
+	CollapseShared bool                   `json:"CollapseShared"` // 共享同一上游的网卡只保留最快的一张参与调度
+	Include        []InterfaceRule        `json:"Include"`        // 为空时不限制
+	Exclude        []InterfaceRule        `json:"Exclude"`        // 未配置时使用 DefaultExcludeRules，配置为 [] 则不排除
+}
+
+type NetCardConfigManager struct {
+	mu             sync.RWMutex
+	FilePath       string
+	cards          map[string]NetCardConf
+	collapseShared bool
+	include        []InterfaceRule
+	exclude        []InterfaceRule
+}
+
+const NetCardConfigFilePath = "./NetCardConfig.json"
+
+var GloNetCardConfig = &NetCardConfigManager{
+	FilePath: NetCardConfigFilePath,
+	cards:    make(map[string]NetCardConf),
+}
+
+// LoadConfig 加载网卡配置，文件不存在不算错误（按空配置处理，切换配置方案时清除上一方案的配置）
+func (m *NetCardConfigManager) LoadConfig() error {
+	m.mu.RLock()
+	filePath := m.FilePath
+	m.mu.RUnlock()
+	var config NetCardConfigFile
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("wrong Explanation: %s\n", err)
+		}
+	}
+	for IP, conf := range config.Cards {
+		for _, rule := range conf.Schedule {
+			if err := rule.Validate(); err != nil {
+				return fmt.Errorf("card %s schedule: %w", IP, err)
+			}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cards = make(map[string]NetCardConf)
+	for IP, conf := range config.Cards {
+		m.cards[IP] = conf
+	}
+	m.collapseShared = config.CollapseShared
+	m.include = config.Include
+	m.exclude = config.Exclude
+	println("Load Done NetCard Config...")
+	return nil
+}
+
+// CheckCard 获取网卡配置：IP精确匹配优先，其次网卡名，再次 "*"，都没有时返回零值
+func (m *NetCardConfigManager) CheckCard(IP string) NetCardConf {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if conf, ok := m.cards[IP]; ok {
+		return conf
+	}
+	if conf, ok := m.cards[GloSiblings.Name(IP)]; ok {
+		return conf
+	}
+	return m.cards["*"]
+}
+
+func (m *NetCardConfigManager) CollapseShared() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.collapseShared
+}
+
+// ClientComCount 网卡的分块连接数
+func ClientComCount(IP string) int {
+	if n := GloNetCardConfig.CheckCard(IP).ClientComNum; n > 0 {
+		return n
+	}
+	return ClientComNum
+}
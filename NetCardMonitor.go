@@ -16,14 +16,14 @@ import (
 )
 
 const CheckInterval = 500 * time.Millisecond
-const ClientComNum = 2
+const ClientComNum = 2 // 每张网卡默认的分块连接数，可在 NetCardConfig.json 中按网卡覆盖
 
 // 纯进行记录的原子bytes
 
 type ClientBytes struct {
-	clientChunks0Bytes atomic.Int64
-	clientChunks1Bytes atomic.Int64
-	clientProbeBytes   atomic.Int64
+	clientProbeBytes  atomic.Int64
+	clientChunksBytes []atomic.Int64 // 下标与 CommonClient 一致
+	outstanding       []atomic.Int64 // 各分块连接上已发出但未完成的字节数
 }
 type ClientBytesRecorder struct {
 	content sync.Map
@@ -76,7 +76,8 @@ type BestChunkSizeFrame struct {
 	mu      sync.RWMutex
 }
 type NetHTTPCho struct {
-	current atomic.Pointer[NetCardHTTPCho]
+	current     atomic.Pointer[NetCardHTTPCho]
+	byScheduler sync.Map // 调度器名 -> *NetCardHTTPCho
 }
 type NetHTTPInfo struct {
 	mu      sync.RWMutex
@@ -102,38 +103,118 @@ var NetCardClient = &NetHTTPClient{
 	Content: make(map[string]*NetCardHTTPClient),
 }
 
+// Probe 获取网卡的Probe客户端，网卡已被移除时返回错误
+func (p *NetHTTPClient) Probe(IP string) (*http.Client, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	clients, ok := p.Content[IP]
+	if !ok {
+		return nil, fmt.Errorf("netcard %s not available", IP)
+	}
+	return clients.ProbeClient, nil
+}
+
+// Common 获取网卡的第 index 条分块客户端
+func (p *NetHTTPClient) Common(IP string, index int) (*http.Client, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	clients, ok := p.Content[IP]
+	if !ok || index < 0 || index >= len(clients.CommonClient) {
+		return nil, fmt.Errorf("netcard %s client %d not available", IP, index)
+	}
+	return clients.CommonClient[index], nil
+}
+
 func (r *ClientBytesRecorder) GetOrCreate(ip string) *ClientBytes {
-	actual, _ := r.content.LoadOrStore(ip, &ClientBytes{})
+	if val, ok := r.content.Load(ip); ok {
+		return val.(*ClientBytes)
+	}
+	actual, _ := r.content.LoadOrStore(ip, &ClientBytes{
+		clientChunksBytes: make([]atomic.Int64, ClientComCount(ip)),
+		outstanding:       make([]atomic.Int64, ClientComCount(ip)),
+	})
 	return actual.(*ClientBytes)
 }
 
+// AddChunk 记录第 index 条分块连接的字节数
+func (c *ClientBytes) AddChunk(index int, n int) {
+	if index >= 0 && index < len(c.clientChunksBytes) {
+		c.clientChunksBytes[index].Add(int64(n))
+	}
+}
+
+// AddOutstanding 分块开始时加上区间大小，结束时减去
+func (c *ClientBytes) AddOutstanding(index int, n int64) {
+	if index >= 0 && index < len(c.outstanding) {
+		c.outstanding[index].Add(n)
+	}
+}
+func (c *ClientBytes) Outstanding(index int) int64 {
+	if index >= 0 && index < len(c.outstanding) {
+		return c.outstanding[index].Load()
+	}
+	return 0
+}
+func (c *ClientBytes) ChunkBytes(index int) int64 {
+	if index >= 0 && index < len(c.clientChunksBytes) {
+		return c.clientChunksBytes[index].Load()
+	}
+	return 0
+}
+
 // InitNetCardInfo 初始化检测网卡
 func InitNetCardInfo() {
 	NetworkTester.mu.Lock()
 	defer NetworkTester.mu.Unlock()
+	for IP, NetInfoTester := range scanNetCards() {
+		NetworkTester.NetCardInfo[IP] = NetInfoTester
+	}
+	return
+}
+
+// scanNetCards 列出当前处于启用状态、未被 Include/Exclude 规则排除的非回环网卡
+// 每张网卡最多给出一个IPv4与一个IPv6源地址，分别作为独立路径
+func scanNetCards() map[string]*NetCardInfoPara {
+	found := make(map[string]*NetCardInfoPara)
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		fmt.Errorf("找不到网卡信息: %v", err)
+		fmt.Printf("找不到网卡信息: %v\n", err)
+		return found
 	}
+	gateways := defaultGateways()
 	for _, ifaces := range interfaces {
 		if ifaces.Flags&net.FlagUp == 0 {
 			continue
 		}
-		NetInfoTester := &NetCardInfoPara{}
+		meta := describeInterface(ifaces, gateways)
+		if !GloNetCardConfig.InterfaceAllowed(meta) {
+			continue
+		}
+		NetInfoTester := &NetCardInfoPara{NetCardMeta: meta}
+		NetInfoTester6 := &NetCardInfoPara{NetCardMeta: meta}
 		addrs, er := ifaces.Addrs()
 		if er == nil {
 			for _, addr := range addrs {
-				if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-					IP := ipnet.IP.String()
-					NetInfoTester.IP = IP
+				ipnet, ok := addr.(*net.IPNet)
+				if !ok || ipnet.IP.IsLoopback() {
+					continue
+				}
+				if ipnet.IP.To4() != nil {
+					NetInfoTester.IP = ipnet.IP.String()
+				} else if usableIPv6(ipnet.IP) && NetInfoTester6.IP == "" {
+					NetInfoTester6.IP = ipnet.IP.String()
 				}
 			}
 		}
 		if len(NetInfoTester.IP) > 0 {
-			NetworkTester.NetCardInfo[NetInfoTester.IP] = NetInfoTester
+			found[NetInfoTester.IP] = NetInfoTester
+		}
+		if len(NetInfoTester6.IP) > 0 {
+			found[NetInfoTester6.IP] = NetInfoTester6
 		}
 	}
-	return
+	GloSiblings.Update(found)
+	return found
 }
 
 // IPHTTPClientAndChoInit 绑定对应HTTP客户端 && 同时进行初始化ClientEntry保证开始阶段可以正常进行读取
@@ -147,11 +228,13 @@ func IPHTTPClientAndChoInit() {
 	for LocalIP := range Content {
 		fmt.Printf("发现当前IP: %s\n", LocalIP)
 		TransportPoolCreate(LocalIP)
-		EntriesChunks = append(EntriesChunks,
-			ChunksClientEntry{
-				IP:    LocalIP,
-				Index: 0,
-			})
+		for i := 0; i < ClientComCount(LocalIP); i++ {
+			EntriesChunks = append(EntriesChunks,
+				ChunksClientEntry{
+					IP:    LocalIP,
+					Index: i,
+				})
+		}
 		EntriesProbe = append(EntriesProbe,
 			ProbeClientEntry{
 				IP: LocalIP,
@@ -171,41 +254,45 @@ func TransportPoolCreate(LocalIP string) {
 	var ClientInfo []*NetCardClientInfo
 	// 检测文件大小所需连接特征：连接短，不需要过多网速要求，不采用特殊动态调配
 	probeTransport := &http.Transport{
-		DialContext: (&net.Dialer{
+		// 使用该网卡自己的DNS解析
+		DialContext: NICDialContext(LocalIP, &net.Dialer{
 			Timeout:   10 * time.Second, // Host连接超时时间
 			KeepAlive: 30 * time.Second, // 发送连接包维持连接间隔
 			LocalAddr: &net.TCPAddr{
 				IP: net.ParseIP(LocalIP),
 			},
-		}).DialContext,
+			Control: BindControl(LocalIP),
+		}),
 		TLSClientConfig: &tls.Config{
 			NextProtos:         []string{"h2", "http/1.1"},
 			ClientSessionCache: tls.NewLRUClientSessionCache(128),
 		},
-		ForceAttemptHTTP2:   true,
-		MaxIdleConnsPerHost: 10, // 每个Host的最大连接数
-		MaxConnsPerHost:     50,
-		MaxIdleConns:        1000,              // 最大连接数
-		IdleConnTimeout:     120 * time.Second, // 空闲连接的最大时间
-		DisableKeepAlives:   false,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   10, // 每个Host的最大连接数
+		MaxConnsPerHost:       50,
+		MaxIdleConns:          1000,              // 最大连接数
+		IdleConnTimeout:       120 * time.Second, // 空闲连接的最大时间
+		ResponseHeaderTimeout: 30 * time.Second,  // 等待响应头的时间限制
+		DisableKeepAlives:     false,
 	}
 	http2.ConfigureTransport(probeTransport) // 添加支持HTTP2注入
-	// probeClient
+	// probeClient：不设置总时长，Body按空闲时间超时，避免慢速大文件被截断
 	probeClient := &http.Client{
-		Transport:     probeTransport,
-		Timeout:       30 * time.Second, // 每个请求返回的完整时间限制
+		Transport:     &IdleTimeoutTransport{Base: probeTransport, Idle: ClientIdleTimeout},
+		Timeout:       0,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
 	}
 	ClientInfo = append(ClientInfo, &NetCardClientInfo{bytesInterval: 0})
 
 	// 采用一种新的方式，为避免创建过多的client，采用每个client-transport-host单个结构，进行访问的时候进行分开铺展方式
 	var ComClients []*http.Client
-	for i := 0; i < ClientComNum; i++ {
+	for i := 0; i < ClientComCount(LocalIP); i++ {
 		TransportCom := AddTransportCom(LocalIP)
 		http2.ConfigureTransport(TransportCom)
+		GloEdgeTracker.Register(LocalIP, TransportCom)
 		CommonClient := &http.Client{
-			Transport:     TransportCom,
-			Timeout:       0, // 无限时间
+			Transport:     &IdleTimeoutTransport{Base: TransportCom, Idle: ClientIdleTimeout},
+			Timeout:       0, // 无总时长限制，卡死由空闲超时与分块看门狗处理
 			CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
 		}
 		ComClients = append(ComClients, CommonClient)
@@ -229,24 +316,27 @@ func TransportPoolCreate(LocalIP string) {
 }
 func AddTransportCom(LocalIP string) *http.Transport {
 	CommonTransport := &http.Transport{
-		DialContext: (&net.Dialer{
+		// 在目标的多个服务器地址间轮转，不同连接落到不同节点
+		DialContext: EdgeDialContext(LocalIP, &net.Dialer{
 			Timeout:   10 * time.Second,
 			KeepAlive: 30 * time.Second,
 			LocalAddr: &net.TCPAddr{
 				IP: net.ParseIP(LocalIP),
 			},
-		}).DialContext,
+			Control: BindControl(LocalIP),
+		}),
 
 		TLSClientConfig: &tls.Config{
 			NextProtos:         []string{"h2", "http/1.1"},
 			ClientSessionCache: tls.NewLRUClientSessionCache(128),
 		},
-		ForceAttemptHTTP2:   true,
-		MaxIdleConnsPerHost: 10,
-		MaxConnsPerHost:     50,
-		MaxIdleConns:        1000,
-		IdleConnTimeout:     300 * time.Second,
-		DisableKeepAlives:   false,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   10,
+		MaxConnsPerHost:       50,
+		MaxIdleConns:          1000,
+		IdleConnTimeout:       300 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		DisableKeepAlives:     false,
 	}
 	return CommonTransport
 }
@@ -271,6 +361,79 @@ func (p *NetHTTPCho) getProbeClientP() (string, error) {
 	return last.IP, nil
 }
 
+// getProbeClientExcept 按概率获取Probe网卡，尽量避开指定网卡（只有一张网卡时仍返回它，换一条新连接）
+func (p *NetHTTPCho) getProbeClientExcept(exceptIP string) (string, error) {
+	snapshot := p.current.Load()
+	if len(snapshot.ProbeEntries) == 0 {
+		return "", fmt.Errorf("probe no probability available")
+	}
+	var candidates []ProbeClientEntry
+	var total float64
+	for _, Entry := range snapshot.ProbeEntries {
+		if Entry.IP != exceptIP {
+			candidates = append(candidates, Entry)
+			total += Entry.ProbNum
+		}
+	}
+	if len(candidates) == 0 {
+		return exceptIP, nil
+	}
+	target := rand.Float64() * total
+	acc := 0.0
+	for _, Entry := range candidates {
+		acc += Entry.ProbNum
+		if target < acc {
+			return Entry.IP, nil
+		}
+	}
+	return candidates[len(candidates)-1].IP, nil
+}
+
+// getBestProbeIP 获取当前Probe概率最高的网卡，用于加速失败后的单流降级
+func (p *NetHTTPCho) getBestProbeIP() (string, error) {
+	snapshot := p.current.Load()
+	if len(snapshot.ProbeEntries) == 0 {
+		return "", fmt.Errorf("probe no probability available")
+	}
+	best := snapshot.ProbeEntries[0]
+	for _, Entry := range snapshot.ProbeEntries[1:] {
+		if Entry.ProbNum > best.ProbNum {
+			best = Entry
+		}
+	}
+	return best.IP, nil
+}
+
+// ReassignChunk 为失败的分块重新挑选客户端：按当前概率选择，尽量避开原来的网卡/连接
+func (p *NetHTTPCho) ReassignChunk(task ChunkTask) ChunkTask {
+	snapshot := p.current.Load()
+	var candidates []ChunksClientEntry
+	var total float64
+	for _, Entry := range snapshot.ChunksEntries {
+		if Entry.IP == task.ClientIP && Entry.Index == task.ClientIndex {
+			continue
+		}
+		candidates = append(candidates, Entry)
+		total += Entry.ProbNum
+	}
+	if len(candidates) == 0 {
+		return task
+	}
+	chosen := candidates[len(candidates)-1]
+	target := rand.Float64() * total
+	acc := 0.0
+	for _, Entry := range candidates {
+		acc += Entry.ProbNum
+		if target < acc {
+			chosen = Entry
+			break
+		}
+	}
+	task.ClientIP = chosen.IP
+	task.ClientIndex = chosen.Index
+	return task
+}
+
 // PeriodCheck 进行定时的对应相关参数计算
 func (p *NetHTTPInfo) PeriodCheck(wg *sync.WaitGroup, MonitorCtx context.Context, MonitorCancel context.CancelFunc) {
 	defer wg.Done()
@@ -282,53 +445,37 @@ func (p *NetHTTPInfo) PeriodCheck(wg *sync.WaitGroup, MonitorCtx context.Context
 			return
 		default:
 		}
-		var ChunksEntries []ChunksClientEntry
-		var ProbeEntries []ProbeClientEntry
-		var accChunks float64
-		var accProbe float64
+		var Cards []CardSample
 		uiCards := make([]UICardInfo, 0)
 		Content := p.Content
 		p.mu.Lock()
 		for LocalIP, CardInfoListAd := range Content {
-			// 获取对应bytes
+			// 获取对应bytes：EachClient[0] 为Probe，其后依次为各条分块连接
 			var SpeedNetCard = 0.0
-			var ProbeBytes int64
-			var Chunks0Bytes int64
-			var Chunks1Bytes int64
-			// 使用 Load 方法 (不使用 LoadOrStore，因为只想读)
+			EachBytes := make([]int64, len(CardInfoListAd.EachClient))
+			EachOutstanding := make([]int64, len(CardInfoListAd.EachClient)-1)
+			// 使用 Load 方法 (不使用 LoadOrStore，因为只想读)，没找到（还没开始下载）时默认为 0
 			if val, ok := NetCardBytes.content.Load(LocalIP); ok {
-				// 类型断言
 				counters := val.(*ClientBytes)
-				// 读取原子值
-				ProbeBytes = counters.clientProbeBytes.Load()
-				Chunks0Bytes = counters.clientChunks0Bytes.Load()
-				Chunks1Bytes = counters.clientChunks1Bytes.Load()
-			} else {
-				// 如果没找到（还没开始下载），默认为 0
-				ProbeBytes = 0
-				Chunks0Bytes = 0
-				Chunks1Bytes = 0
+				EachBytes[0] = counters.clientProbeBytes.Load()
+				for i := 1; i < len(EachBytes); i++ {
+					EachBytes[i] = counters.ChunkBytes(i - 1)
+					EachOutstanding[i-1] = counters.Outstanding(i - 1)
+				}
 			}
-			//fmt.Printf("ProbeBytes: %v; Chunk0Bytes: %v; Chunk1Bytes: %v\n", ProbeBytes, Chunks0Bytes, Chunks1Bytes)
 
-			ProbeBytesLast := CardInfoListAd.EachClient[0].bytesInterval
-			Chunks0BytesLast := CardInfoListAd.EachClient[1].bytesInterval
-			Chunks1BytesLast := CardInfoListAd.EachClient[2].bytesInterval
-			//fmt.Printf("ProbeBytesLast: %v; Chunk0BytesLast: %v; Chunk1BytesLast: %v\n", ProbeBytesLast, Chunks0BytesLast, Chunks1BytesLast)
 			// 计算对应当前速度
 			Interval := time.Since(CardInfoListAd.Time).Seconds()
-			ProbeSp := float64(ProbeBytes-ProbeBytesLast) / (Interval * (1024 * 1024))
-			Chunks0Sp := float64(Chunks0Bytes-Chunks0BytesLast) / (Interval * (1024 * 1024))
-			Chunks1Sp := float64(Chunks1Bytes-Chunks1BytesLast) / (Interval * (1024 * 1024))
-
+			EachSpeed := make([]float64, len(EachBytes))
+			for i, ClientInfo := range CardInfoListAd.EachClient {
+				EachSpeed[i] = float64(EachBytes[i]-ClientInfo.bytesInterval) / (Interval * (1024 * 1024))
+				ClientInfo.bytesInterval = EachBytes[i]
+				SpeedNetCard += EachSpeed[i]
+			}
 			// 更新时间（改于25-11-19）
 			CardInfoListAd.Time = time.Now()
-			CardInfoListAd.EachClient[0].bytesInterval = ProbeBytes
-			CardInfoListAd.EachClient[1].bytesInterval = Chunks0Bytes
-			CardInfoListAd.EachClient[2].bytesInterval = Chunks1Bytes
 
 			// 计算出最新的有关modelSpeed
-			SpeedNetCard = ProbeSp + Chunks0Sp + Chunks1Sp
 			alpha := 0.0
 			updater := 0.0
 			StandardSpeed := CardInfoListAd.StandardSpeed
@@ -356,49 +503,44 @@ func (p *NetHTTPInfo) PeriodCheck(wg *sync.WaitGroup, MonitorCtx context.Context
 			// 更新对应CardInfo内容
 			CardInfoListAd.StandardSpeed = StandardSpeed
 			// 更新ui部分
+			Health := GloNICHealth.Status(LocalIP)
+			Upstream, SharedWith, SharedReason := GloSharedUpstream.Info(LocalIP)
+			var Meta NetCardMeta
+			if Info := NetworkTester.InterfaceSearch(LocalIP); Info != nil {
+				Meta = Info.NetCardMeta
+			}
 			uiCards = append(uiCards, UICardInfo{
 				IP:            LocalIP,
 				StandardSpeed: StandardSpeed,
-				NowSpeed:      SpeedNetCard, // 这是你算出来的 SpeedNetCard
-				ProbeSpeed:    ProbeSp,      // 实时 Probe 速度
-				Chunk0Speed:   Chunks0Sp,    // 实时 Chunk0 速度
-				Chunk1Speed:   Chunks1Sp,    // 实时 Chunk1 速度
+				NowSpeed:      SpeedNetCard,  // 这是你算出来的 SpeedNetCard
+				ProbeSpeed:    EachSpeed[0],  // 实时 Probe 速度
+				ChunkSpeeds:   EachSpeed[1:], // 各分块连接的实时速度
+				Health:        Health.State,
+				HealthReason:  Health.Reason,
+				PortalURL:     Health.PortalURL,
+				PublicIP:      Upstream.PublicIP,
+				SharedWith:    SharedWith,
+				SharedReason:  SharedReason,
+				Meta:          Meta,
+				Quota:         GloQuota.Status(LocalIP),
+				Schedule:      GloNICSchedule.Status(LocalIP),
 			})
 
-			// 计算Prob
-			var ProbeP float64
-			var Chunks0P float64
-			var Chunks1P float64
-			if StandardSpeed > SpeedNetCard {
-				ProbeP = (StandardSpeed) * (1 - ProbeSp/(StandardSpeed-Chunks0Sp-Chunks1Sp)) * (1 - ProbeSp/(StandardSpeed-Chunks0Sp-Chunks1Sp))
-				Chunks0P = (StandardSpeed) * (1 - Chunks0Sp/(StandardSpeed-Chunks1Sp-ProbeSp)) * (1 - Chunks0Sp/(StandardSpeed-Chunks1Sp-ProbeSp))
-				Chunks1P = (StandardSpeed) * (1 - Chunks1Sp/(StandardSpeed-ProbeSp-Chunks0Sp)) * (1 - Chunks1Sp/(StandardSpeed-ProbeSp-Chunks0Sp))
-			} else {
-				ProbeP = (StandardSpeed) * (1 - ProbeSp/(SpeedNetCard-Chunks0Sp-Chunks1P)) * (1 - ProbeSp/(SpeedNetCard-Chunks0Sp-Chunks1P))
-				Chunks0P = (StandardSpeed) * (1 - Chunks0Sp/(SpeedNetCard-Chunks1P-ProbeSp)) * (1 - Chunks0Sp/(SpeedNetCard-Chunks1P-ProbeSp))
-				Chunks1P = (StandardSpeed) * (1 - Chunks1Sp/(SpeedNetCard-ProbeSp-Chunks0P)) * (1 - Chunks1Sp/(SpeedNetCard-ProbeSp-Chunks0P))
-			}
-
-			// 构建snap
-			ProbeEntries = append(ProbeEntries, ProbeClientEntry{IP: LocalIP, ProbNum: ProbeP})
-			ChunksEntries = append(ChunksEntries, ChunksClientEntry{IP: LocalIP, Index: 0, ProbNum: Chunks0P})
-			ChunksEntries = append(ChunksEntries, ChunksClientEntry{IP: LocalIP, Index: 1, ProbNum: Chunks1P})
-			accChunks += Chunks0P
-			accChunks += Chunks1P
-			accProbe += ProbeP
-			//fmt.Printf("IP: %s - ProbeSpeed: %v, Chunks0Speed: %v, Chunks1Speed: %v; ProbeP : %v, Chunks0P: %v, Chunks1P: %v \n", LocalIP, ProbeSp, Chunks0Sp, Chunks1Sp, ProbeP, Chunks0P, Chunks1P)
+			// 收集样本，交给调度器计算概率
+			Cards = append(Cards, CardSample{
+				IP:            LocalIP,
+				StandardSpeed: StandardSpeed,
+				NowSpeed:      SpeedNetCard,
+				Speeds:        EachSpeed,
+				Outstanding:   EachOutstanding,
+			})
 			//fmt.Printf("CardIPSpeed: %v\n", CardInfoListAd.StandardSpeed)
 		}
 
 		p.mu.Unlock()
 
-		NewSnapshot := &NetCardHTTPCho{
-			ChunksEntries: ChunksEntries,
-			TotalChunks:   accChunks,
-			ProbeEntries:  ProbeEntries,
-			TotalProbe:    accProbe,
-		}
-		NetCardCho.current.Store(NewSnapshot)
+		// 不健康、超出配额、按分时规则停用的网卡不参与调度
+		NetCardCho.PublishSnapshots(collapseShared(applySchedules(applyQuotas(filterHealthy(Cards)))))
 
 		BroadcastUpdate(uiCards)
 		time.Sleep(CheckInterval)
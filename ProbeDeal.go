@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 探测阶段：真实响应使用 chunked 传输、缺少 Content-Length 或缺少 Accept-Ranges 时，
+// 再发起 Range: bytes=0-0，获取总大小、是否支持Range以及校验值，依靠该结果决定是否升级为分块加速
+
+const ProbeWait = 3 * time.Second // 真实响应到达后等待探测结果的最长时间
+
+type ProbeResult struct {
+	Total     int64 // 文件总大小，未知为-1
+	Rangeable bool  // 是否返回了合规的206
+	Header    http.Header
+	Err       error
+}
+
+// NeedsRangeProbe 真实响应无法直接判断能否分块时才需要探测；已知长度且小于阈值的不探测
+func NeedsRangeProbe(resp *http.Response, threshold int64) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < threshold {
+		return false
+	}
+	return resp.ContentLength < 0 || len(resp.TransferEncoding) > 0 ||
+		!strings.EqualFold(strings.TrimSpace(resp.Header.Get("Accept-Ranges")), "bytes")
+}
+
+// StartRangeProbe 在指定网卡的probeClient上并行发起探测
+func StartRangeProbe(ctx context.Context, IP string, targetURL string, Headers http.Header) <-chan ProbeResult {
+	ch := make(chan ProbeResult, 1)
+	go func() {
+		ch <- RangeProbe(ctx, IP, targetURL, Headers)
+	}()
+	return ch
+}
+
+func RangeProbe(ctx context.Context, IP string, targetURL string, Headers http.Header) ProbeResult {
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL, nil)
+	if err != nil {
+		return ProbeResult{Total: -1, Err: err}
+	}
+	req.Header = Headers.Clone()
+	req.Header = ReqH1ToH2Headers(req.Header)
+	req.Header.Del("If-Range")
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	GloNICHealth.Report(IP, err)
+	if err != nil {
+		return ProbeResult{Total: -1, Err: err}
+	}
+	// 与真实请求一样跟随重定向到最终地址
+	resp, err = FollowRedirects(ctx, client, resp, req.Header)
+	if err != nil {
+		return ProbeResult{Total: -1, Err: err}
+	}
+	defer resp.Body.Close()
+	// 只读掉少量内容，忽略Range的服务器会返回整个文件
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != 0 || total <= 0 {
+			return ProbeResult{Total: total, Header: resp.Header, Err: fmt.Errorf("probe invalid Content-Range: %q", resp.Header.Get("Content-Range"))}
+		}
+		return ProbeResult{Total: total, Rangeable: true, Header: resp.Header}
+	case http.StatusOK:
+		return ProbeResult{Total: resp.ContentLength, Header: resp.Header}
+	default:
+		return ProbeResult{Total: -1, Header: resp.Header, Err: fmt.Errorf("probe status %d", resp.StatusCode)}
+	}
+}
+
+// waitProbe 等待探测结果，超时或ctx结束视为无结果
+func waitProbe(ctx context.Context, ch <-chan ProbeResult) (ProbeResult, bool) {
+	if ch == nil {
+		return ProbeResult{}, false
+	}
+	timer := time.NewTimer(ProbeWait)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res, res.Err == nil
+	case <-timer.C:
+		return ProbeResult{}, false
+	case <-ctx.Done():
+		return ProbeResult{}, false
+	}
+}
+
+// UpgradeByProbe 真实响应未声明可分块时，用探测结果判断能否升级：
+// 探测返回206、文件足够大、与真实响应的长度和校验值一致
+func UpgradeByProbe(res ProbeResult, resp *http.Response, bag *ChunkBag, threshold int64) bool {
+	if !res.Rangeable || res.Total < threshold || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != res.Total {
+		return false
+	}
+	if !bag.SameVersion(res.Header) {
+		return false
+	}
+	// 真实响应缺少校验值时使用探测结果中的
+	if bag.ETag == "" {
+		bag.ETag = res.Header.Get("ETag")
+	}
+	if bag.LastModified == "" {
+		bag.LastModified = res.Header.Get("Last-Modified")
+	}
+	bag.AllBytes = res.Total
+	bag.stateCode = http.StatusOK
+	return true
+}
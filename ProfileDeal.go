@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 网络配置方案：每个方案指定一套策略文件、网卡配置文件与默认调度器，对应家里、办公室、出差等不同网络环境
+// 启动时与网卡变化后按网关MAC、网段、网卡组合自动选择第一个匹配的方案，没有匹配时使用 Default；
+// 也可以在 dashboard 或控制台（输入 "profile <名称>"）手动切换，手动选择后不再自动切换，直到选择 "auto"
+// 切换时重新加载两份配置并重新初始化网卡状态（增删网卡、按新配置重建连接），无需重启
+
+const (
+	ProfilesFilePath = "./Profiles.json"
+	ProfileAuto      = "auto"
+)
+
+// ProfileMatch 方案的匹配条件，配置了的条件都要满足；一个条件都没有的方案只能手动选择
+type ProfileMatch struct {
+	GatewayMACs []string `json:"GatewayMACs"` // 任一网卡的默认网关MAC在其中（Linux、Windows）
+	Subnets     []string `json:"Subnets"`     // 任一网卡地址落在其中的网段（CIDR）
+	Interfaces  []string `json:"Interfaces"`  // 这些网卡都存在（网卡名，支持通配符）
+}
+
+type NetProfile struct {
+	Name          string       `json:"Name"`
+	Match         ProfileMatch `json:"Match"`
+	PolicyFile    string       `json:"PolicyFile"`    // 为空时使用 ./HostPolicy.json
+	NetCardConfig string       `json:"NetCardConfig"` // 为空时使用 ./NetCardConfig.json
+	Scheduler     string       `json:"Scheduler"`     // 策略规则中没有指定调度器的Host使用的调度器，为空时为 ewma
+}
+
+type ProfilesFile struct {
+	Profiles []NetProfile `json:"Profiles"`
+	Default  string       `json:"Default"` // 没有方案匹配时使用
+}
+
+type ProfileManager struct {
+	mu          sync.RWMutex
+	FilePath    string
+	profiles    []NetProfile
+	defaultName string
+	current     string
+	pinned      bool       // 手动选择后不再自动切换
+	switchMu    sync.Mutex // 串行化方案切换
+}
+
+var GloProfiles = &ProfileManager{
+	FilePath: ProfilesFilePath,
+}
+
+// netEnv 当前的网络环境
+type netEnv struct {
+	names       []string
+	addrs       []net.IP
+	gatewayMACs []string
+}
+
+// LoadProfiles 加载方案列表，文件不存在时不启用方案
+func (m *ProfileManager) LoadProfiles() error {
+	data, err := os.ReadFile(m.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var config ProfilesFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("wrong Explanation: %s\n", err)
+	}
+	for _, profile := range config.Profiles {
+		if profile.Name == "" || profile.Name == ProfileAuto {
+			return fmt.Errorf("invalid profile name %q", profile.Name)
+		}
+		if len(profile.Match.GatewayMACs) > 0 && !gatewayMACSupported {
+			return fmt.Errorf("profile %s: GatewayMACs not supported on this platform", profile.Name)
+		}
+		for _, subnet := range profile.Match.Subnets {
+			if _, _, err := net.ParseCIDR(subnet); err != nil {
+				return fmt.Errorf("profile %s: %w", profile.Name, err)
+			}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.profiles = config.Profiles
+	m.defaultName = config.Default
+	println("Load Done Profiles...")
+	return nil
+}
+
+// Current 当前方案名、全部方案名以及是否为手动选择，供dashboard展示
+func (m *ProfileManager) Current() (string, []string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.profiles))
+	for _, profile := range m.profiles {
+		names = append(names, profile.Name)
+	}
+	return m.current, names, m.pinned
+}
+
+// Scheduler 当前方案的默认调度器
+func (m *ProfileManager) Scheduler() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if profile, ok := m.lookup(m.current); ok {
+		return profile.Scheduler
+	}
+	return ""
+}
+
+func (m *ProfileManager) lookup(name string) (NetProfile, bool) {
+	for _, profile := range m.profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return NetProfile{}, false
+}
+
+// detectEnv 收集所有启用的非回环网卡（不受 Include/Exclude 限制）
+func detectEnv() netEnv {
+	var env netEnv
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return env
+	}
+	gateways := defaultGateways()
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		meta := describeInterface(iface, gateways)
+		env.names = append(env.names, meta.Name)
+		for _, addr := range meta.Addrs {
+			if IP, _, err := net.ParseCIDR(addr); err == nil {
+				env.addrs = append(env.addrs, IP)
+			}
+		}
+		if mac := gatewayMAC(meta.Name); mac != "" {
+			env.gatewayMACs = append(env.gatewayMACs, mac)
+		}
+	}
+	return env
+}
+
+// Matches 判断方案是否适用于当前网络环境
+func (p ProfileMatch) Matches(env netEnv) bool {
+	if len(p.GatewayMACs) == 0 && len(p.Subnets) == 0 && len(p.Interfaces) == 0 {
+		return false
+	}
+	if len(p.GatewayMACs) > 0 && !anyGatewayMAC(p.GatewayMACs, env.gatewayMACs) {
+		return false
+	}
+	if len(p.Subnets) > 0 && !anyInSubnet(p.Subnets, env.addrs) {
+		return false
+	}
+	for _, pattern := range p.Interfaces {
+		found := false
+		for _, name := range env.names {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func anyGatewayMAC(want []string, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if strings.EqualFold(strings.ReplaceAll(w, "-", ":"), h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyInSubnet(subnets []string, addrs []net.IP) bool {
+	for _, s := range subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			continue
+		}
+		for _, IP := range addrs {
+			if subnet.Contains(IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detect 按顺序取第一个匹配当前环境的方案，都不匹配时为 Default
+func (m *ProfileManager) detect() string {
+	env := detectEnv()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, profile := range m.profiles {
+		if profile.Match.Matches(env) {
+			return profile.Name
+		}
+	}
+	return m.defaultName
+}
+
+// use 指向方案的配置文件并记为当前方案，不加载配置
+func (m *ProfileManager) use(name string) error {
+	m.mu.Lock()
+	profile, ok := m.lookup(name)
+	if ok {
+		m.current = name
+	}
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("profile %q not found", name)
+	}
+	policyFile, cardFile := profile.PolicyFile, profile.NetCardConfig
+	if policyFile == "" {
+		policyFile = PolicyFilePath
+	}
+	if cardFile == "" {
+		cardFile = NetCardConfigFilePath
+	}
+	GlobalPolicyManager.mu.Lock()
+	GlobalPolicyManager.FilePath = policyFile
+	GlobalPolicyManager.mu.Unlock()
+	GloNetCardConfig.mu.Lock()
+	GloNetCardConfig.FilePath = cardFile
+	GloNetCardConfig.mu.Unlock()
+	return nil
+}
+
+// Init 启动时选择方案，须在加载策略与网卡配置之前调用
+func (m *ProfileManager) Init() {
+	name := m.detect()
+	if name == "" {
+		return
+	}
+	if err := m.use(name); err != nil {
+		fmt.Printf("选择配置方案失败: %v\n", err)
+		return
+	}
+	fmt.Printf("🧭 当前配置方案: %s\n", name)
+}
+
+// Switch 手动切换方案，name 为 "auto" 时恢复自动选择
+func (m *ProfileManager) Switch(name string) error {
+	if name == ProfileAuto {
+		m.mu.Lock()
+		m.pinned = false
+		m.mu.Unlock()
+		m.AutoSwitch()
+		return nil
+	}
+	m.mu.RLock()
+	_, ok := m.lookup(name)
+	m.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("profile %q not found", name)
+	}
+	m.switchMu.Lock()
+	defer m.switchMu.Unlock()
+	m.mu.Lock()
+	m.pinned = true
+	m.mu.Unlock()
+	return m.apply(name)
+}
+
+// AutoSwitch 网络环境变化后重新选择方案，手动选择期间不切换
+func (m *ProfileManager) AutoSwitch() {
+	m.switchMu.Lock()
+	defer m.switchMu.Unlock()
+	m.mu.RLock()
+	pinned, current, enabled := m.pinned, m.current, len(m.profiles) > 0
+	m.mu.RUnlock()
+	if pinned || !enabled {
+		return
+	}
+	if name := m.detect(); name != "" && name != current {
+		if err := m.apply(name); err != nil {
+			fmt.Printf("切换配置方案失败: %v\n", err)
+		}
+	}
+}
+
+// apply 切换到方案：重新加载策略与网卡配置，再重新初始化网卡状态；调用方持有 switchMu
+func (m *ProfileManager) apply(name string) error {
+	if err := m.use(name); err != nil {
+		return err
+	}
+	fmt.Printf("🧭 切换配置方案: %s\n", name)
+	if err := GlobalPolicyManager.LoadPolicies(); err != nil {
+		fmt.Printf("Load Policy Error: %v\n", err)
+	}
+	if err := GloNetCardConfig.LoadConfig(); err != nil {
+		fmt.Println("Load NetCard Config Error", err)
+	}
+	ReinitNetCards()
+	return nil
+}
+
+// ProfileCommand 处理控制台命令：profile 列出方案，profile <名称>/auto 切换
+func ProfileCommand(args []string) {
+	if len(args) == 0 {
+		current, names, pinned := GloProfiles.Current()
+		mode := ProfileAuto
+		if pinned {
+			mode = "manual"
+		}
+		fmt.Printf("当前配置方案: %s (%s)，可选: %s\n", current, mode, strings.Join(names, ", "))
+		return
+	}
+	if err := GloProfiles.Switch(args[0]); err != nil {
+		fmt.Printf("切换配置方案失败: %v\n", err)
+	}
+}
+
+// ReinitNetCards 重新初始化网卡状态：按新的 Include/Exclude 增删网卡，保留的网卡按新配置重建连接，
+// 已测得的速度保留，未完成的分块在旧连接上继续完成
+func ReinitNetCards() {
+	hotplugMu.Lock()
+	added, removed, kept := diffNetCards(scanNetCards())
+	for _, IP := range removed {
+		removeNetCard(IP)
+	}
+	for _, Info := range added {
+		addNetCard(Info)
+	}
+	for _, Info := range kept {
+		rebuildNetCard(Info)
+	}
+	hotplugMu.Unlock()
+
+	DiagnoseEgress()
+	if IP := NetCardInfo.InitBestProbeClient(); IP != "" {
+		BestProbeClientIP = IP
+	}
+	go GloSharedUpstream.Detect(context.Background())
+}
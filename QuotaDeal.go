@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 计费链路与流量配额：按网卡（网卡名，v4/v6路径合计）统计用量，定期从 GloNICTraffic 的累计计数取增量，
+// 用量保存在 ./Cache/Usage.json，重启后继续累计
+// 调度：CostWeight>1 的网卡按比例降低样本速度；当日或本周期用量达到上限后不再参与调度
+
+const (
+	QuotaSampleInterval = 2 * time.Second
+	QuotaSaveInterval   = time.Minute
+	UsageFilePath       = "./Cache/Usage.json"
+)
+
+// NICUsage 单张网卡的用量
+type NICUsage struct {
+	Day        string `json:"Day"` // 2006-01-02
+	DayBytes   int64  `json:"DayBytes"`
+	CycleStart string `json:"CycleStart"` // 当前计费周期的起始日
+	CycleBytes int64  `json:"CycleBytes"`
+}
+
+// QuotaStatus 网卡配额状态，供调度与dashboard使用
+type QuotaStatus struct {
+	CostWeight   float64 `json:"cost_weight"`
+	DayBytes     int64   `json:"day_bytes"`
+	DailyQuota   int64   `json:"daily_quota"`
+	CycleBytes   int64   `json:"cycle_bytes"`
+	MonthlyQuota int64   `json:"monthly_quota"`
+	Remaining    int64   `json:"remaining"` // 两项限额中较少的剩余量，-1 为不限
+	Exhausted    bool    `json:"exhausted"`
+}
+
+type QuotaTracker struct {
+	mu       sync.Mutex
+	FilePath string
+	usage    map[string]*NICUsage // 网卡名 -> 用量
+	lastSeen map[string]int64     // 源地址 -> 上次读取的累计字节数
+}
+
+var GloQuota = &QuotaTracker{
+	FilePath: UsageFilePath,
+	usage:    make(map[string]*NICUsage),
+	lastSeen: make(map[string]int64),
+}
+
+// cycleStart 计费周期起始日：本月的 BillingDay 已过则为本月，否则为上月
+func cycleStart(now time.Time, billingDay int) string {
+	if billingDay < 1 || billingDay > 28 {
+		billingDay = 1
+	}
+	start := time.Date(now.Year(), now.Month(), billingDay, 0, 0, 0, 0, now.Location())
+	if now.Day() < billingDay {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start.Format("2006-01-02")
+}
+
+// rollover 跨天/跨计费周期时清零
+func (u *NICUsage) rollover(now time.Time, billingDay int) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if start := cycleStart(now, billingDay); u.CycleStart != start {
+		u.CycleStart = start
+		u.CycleBytes = 0
+	}
+}
+
+func (q *QuotaTracker) getOrCreate(name string) *NICUsage {
+	u, ok := q.usage[name]
+	if !ok {
+		u = &NICUsage{}
+		q.usage[name] = u
+	}
+	return u
+}
+
+// usageName 用量按网卡名统计，名称未知时退回源地址
+func usageName(IP string) string {
+	if name := GloSiblings.Name(IP); name != "" {
+		return name
+	}
+	return IP
+}
+
+// NICTraffic 按源地址统计经网卡拨出的所有连接的收发字节（分块、Probe、直通、健康检查、测速、DNS等），
+// 与 ClientBytesRecorder 不同，网卡重建连接时不清零，重建前的连接上继续传输的字节也会计入
+type NICTraffic struct {
+	content sync.Map // 源地址 -> *atomic.Int64
+}
+
+var GloNICTraffic = &NICTraffic{}
+
+func (t *NICTraffic) counter(IP string) *atomic.Int64 {
+	if val, ok := t.content.Load(IP); ok {
+		return val.(*atomic.Int64)
+	}
+	actual, _ := t.content.LoadOrStore(IP, new(atomic.Int64))
+	return actual.(*atomic.Int64)
+}
+
+// Total 源地址上的累计字节数
+func (t *NICTraffic) Total(IP string) int64 {
+	if val, ok := t.content.Load(IP); ok {
+		return val.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// countingConn 把连接上的收发字节计入源地址
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countConn 按连接实际使用的源地址计数，可直接包裹拨号结果
+func countConn(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	var IP net.IP
+	switch addr := conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		IP = addr.IP
+	case *net.UDPAddr:
+		IP = addr.IP
+	}
+	if IP == nil {
+		return conn, nil
+	}
+	return &countingConn{Conn: conn, n: GloNICTraffic.counter(IP.String())}, nil
+}
+
+// countedDial 给拨号函数加上用量计数
+func countedDial(dial func(ctx context.Context, network string, addr string) (net.Conn, error)) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return countConn(dial(ctx, network, addr))
+	}
+}
+
+// totalBytes 源地址上所有连接的累计字节数
+func totalBytes(IP string) int64 {
+	return GloNICTraffic.Total(IP)
+}
+
+// Sample 读取各源地址的增量并计入用量，新达到上限的网卡立即从快照中剔除
+func (q *QuotaTracker) Sample() {
+	NetCardClient.mu.RLock()
+	IPs := make([]string, 0, len(NetCardClient.Content))
+	for IP := range NetCardClient.Content {
+		IPs = append(IPs, IP)
+	}
+	NetCardClient.mu.RUnlock()
+
+	now := time.Now()
+	var exhausted []string
+	for _, IP := range IPs {
+		total := totalBytes(IP)
+		conf := GloNetCardConfig.CheckCard(IP)
+		q.mu.Lock()
+		delta := total - q.lastSeen[IP]
+		q.lastSeen[IP] = total
+		u := q.getOrCreate(usageName(IP))
+		u.rollover(now, conf.BillingDay)
+		wasExhausted := quotaExhausted(u, conf)
+		u.DayBytes += delta
+		u.CycleBytes += delta
+		if !wasExhausted && quotaExhausted(u, conf) {
+			exhausted = append(exhausted, IP)
+		}
+		q.mu.Unlock()
+	}
+	for _, IP := range exhausted {
+		fmt.Printf("📵 网卡<%s>流量已达上限，停止使用\n", IP)
+		NetCardCho.dropIP(IP)
+		if sib := GloSiblings.Sibling(IP); sib != "" {
+			NetCardCho.dropIP(sib)
+		}
+	}
+}
+
+func quotaExhausted(u *NICUsage, conf NetCardConf) bool {
+	return (conf.DailyQuota > 0 && u.DayBytes >= conf.DailyQuota) ||
+		(conf.MonthlyQuota > 0 && u.CycleBytes >= conf.MonthlyQuota)
+}
+
+// Status 网卡当前的配额状态
+func (q *QuotaTracker) Status(IP string) QuotaStatus {
+	conf := GloNetCardConfig.CheckCard(IP)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.getOrCreate(usageName(IP))
+	u.rollover(time.Now(), conf.BillingDay)
+	status := QuotaStatus{
+		CostWeight:   conf.CostWeight,
+		DayBytes:     u.DayBytes,
+		DailyQuota:   conf.DailyQuota,
+		CycleBytes:   u.CycleBytes,
+		MonthlyQuota: conf.MonthlyQuota,
+		Remaining:    -1,
+		Exhausted:    quotaExhausted(u, conf),
+	}
+	if conf.DailyQuota > 0 {
+		status.Remaining = max(conf.DailyQuota-u.DayBytes, 0)
+	}
+	if conf.MonthlyQuota > 0 {
+		left := max(conf.MonthlyQuota-u.CycleBytes, 0)
+		if status.Remaining < 0 || left < status.Remaining {
+			status.Remaining = left
+		}
+	}
+	return status
+}
+
+// applyQuotas 剔除已达上限的网卡，计费网卡的速度样本按 CostWeight 缩小
+func applyQuotas(cards []CardSample) []CardSample {
+	var out []CardSample
+	for _, card := range cards {
+		status := GloQuota.Status(card.IP)
+		if status.Exhausted {
+			continue
+		}
+		if w := status.CostWeight; w > 1 {
+			card = scaleSample(card, 1/w)
+		}
+		out = append(out, card)
+	}
+	return out
+}
+
+// Run 定时采样并保存用量，退出时的保存由 main 负责
+func (q *QuotaTracker) Run(ctx context.Context) {
+	sample := time.NewTicker(QuotaSampleInterval)
+	defer sample.Stop()
+	save := time.NewTicker(QuotaSaveInterval)
+	defer save.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			q.Sample()
+			return
+		case <-sample.C:
+			q.Sample()
+		case <-save.C:
+			q.SaveLocal()
+		}
+	}
+}
+
+// UsageLoad 读取保存的用量，文件不存在不算错误
+func (q *QuotaTracker) UsageLoad() {
+	data, err := os.ReadFile(q.FilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("读取用量失败: %v\n", err)
+		}
+		return
+	}
+	usage := make(map[string]*NICUsage)
+	if err := json.Unmarshal(data, &usage); err != nil {
+		fmt.Printf("解析用量失败: %v\n", err)
+		return
+	}
+	q.mu.Lock()
+	q.usage = usage
+	q.mu.Unlock()
+}
+
+func (q *QuotaTracker) SaveLocal() {
+	q.mu.Lock()
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.mu.Unlock()
+	if err != nil {
+		fmt.Printf("序列化失败: %v\n", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(q.FilePath), 0o755); err != nil {
+		fmt.Printf("创建目录失败: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(q.FilePath, data, 0o644); err != nil {
+		fmt.Printf("写入文件失败: %v\n", err)
+	}
+}
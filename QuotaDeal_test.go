@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCycleStart(t *testing.T) {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		now        time.Time
+		billingDay int
+		want       string
+	}{
+		{at(2026, 10, 19), 15, "2026-10-15"},
+		{at(2026, 10, 15), 15, "2026-10-15"},
+		{at(2026, 10, 14), 15, "2026-09-15"},
+		{at(2026, 1, 5), 15, "2025-12-15"}, // 跨年
+		{at(2026, 3, 10), 28, "2026-02-28"},
+		{at(2026, 10, 19), 1, "2026-10-01"},
+		{at(2026, 10, 19), 0, "2026-10-01"},  // 未设置
+		{at(2026, 10, 19), 31, "2026-10-01"}, // 超出范围按1号
+	}
+	for _, tt := range tests {
+		if got := cycleStart(tt.now, tt.billingDay); got != tt.want {
+			t.Errorf("cycleStart(%s, %d) = %s, want %s", tt.now.Format("2006-01-02"), tt.billingDay, got, tt.want)
+		}
+	}
+}
+
+func TestNICUsageRollover(t *testing.T) {
+	at := func(month time.Month, day int, hour int) time.Time {
+		return time.Date(2026, month, day, hour, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name      string
+		usage     NICUsage
+		now       time.Time
+		wantDay   int64
+		wantCycle int64
+	}{
+		{"same day", NICUsage{Day: "2026-10-19", DayBytes: 10, CycleStart: "2026-10-15", CycleBytes: 100}, at(10, 19, 23), 10, 100},
+		{"next day", NICUsage{Day: "2026-10-19", DayBytes: 10, CycleStart: "2026-10-15", CycleBytes: 100}, at(10, 20, 0), 0, 100},
+		{"next cycle", NICUsage{Day: "2026-11-14", DayBytes: 10, CycleStart: "2026-10-15", CycleBytes: 100}, at(11, 15, 0), 0, 0},
+		{"cycle eve", NICUsage{Day: "2026-11-13", DayBytes: 10, CycleStart: "2026-10-15", CycleBytes: 100}, at(11, 14, 23), 0, 100},
+		{"fresh", NICUsage{}, at(10, 19, 12), 0, 0},
+	}
+	for _, tt := range tests {
+		u := tt.usage
+		u.rollover(tt.now, 15)
+		if u.DayBytes != tt.wantDay || u.CycleBytes != tt.wantCycle {
+			t.Errorf("%s: DayBytes=%d CycleBytes=%d, want %d %d", tt.name, u.DayBytes, u.CycleBytes, tt.wantDay, tt.wantCycle)
+		}
+		if u.Day != tt.now.Format("2006-01-02") || u.CycleStart != cycleStart(tt.now, 15) {
+			t.Errorf("%s: Day=%s CycleStart=%s not updated", tt.name, u.Day, u.CycleStart)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 重定向处理：所有client都设置了 ErrUseLastResponse，这里在探测阶段由代理自己跟随重定向链，
+// 把最终地址（签名存储地址等）固定给所有分块Worker，客户端看到的仍是原始URL的响应
+
+const MaxRedirects = 10
+
+// PinnedURL 重定向解析后固定使用的最终地址；短时效签名地址过期时从原始地址重新解析
+type PinnedURL struct {
+	mu      sync.RWMutex
+	origin  string
+	current string
+	header  http.Header
+}
+
+func NewPinnedURL(origin string, current string, Headers http.Header) *PinnedURL {
+	return &PinnedURL{origin: origin, current: current, header: Headers.Clone()}
+}
+func (p *PinnedURL) Get() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current
+}
+
+// Reresolve 从原始地址重新解析；stale 为失败请求所使用的地址，已被其他分块刷新过则直接返回
+// 请求期间不持锁，其他分块的 Get 不受影响；完成后只在地址仍为 stale 时替换
+func (p *PinnedURL) Reresolve(ctx context.Context, stale string) error {
+	if p.Get() != stale {
+		return nil
+	}
+	IP, err := NetCardCho.getBestProbeIP()
+	if err != nil {
+		return err
+	}
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.origin, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = ReqH1ToH2Headers(p.header.Clone())
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp, err = FollowRedirects(ctx, client, resp, req.Header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("re-resolve %s: status %d", p.origin, resp.StatusCode)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current != stale {
+		return nil
+	}
+	p.current = resp.Request.URL.String()
+	fmt.Printf("🔁 重新解析重定向地址: %s\n", p.current)
+	return nil
+}
+
+func isRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// FollowRedirects 从一个3xx响应开始跟随重定向链，返回最终的非3xx响应（最终地址见 resp.Request.URL）
+// 原始请求的Cookie/Authorization在同一站点内原样携带，跨站点时去掉，避免干扰签名地址（与浏览器行为一致）
+// 303 之后改用 GET（HEAD 保持不变，RFC 9110 §15.4.4）
+func FollowRedirects(ctx context.Context, client *http.Client, resp *http.Response, Headers http.Header) (*http.Response, error) {
+	origin := resp.Request.URL
+	method := resp.Request.Method
+	for hop := 0; isRedirectStatus(resp.StatusCode); hop++ {
+		loc, err := resp.Location()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("redirect without Location: %w", err)
+		}
+		if hop >= MaxRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects", MaxRedirects)
+		}
+		if resp.StatusCode == http.StatusSeeOther && method != http.MethodHead {
+			method = http.MethodGet
+		}
+		req, err := http.NewRequestWithContext(ctx, method, loc.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = redirectHeaders(Headers, origin, loc)
+		resp, err = client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func redirectHeaders(Headers http.Header, origin *url.URL, to *url.URL) http.Header {
+	h := ReqH1ToH2Headers(Headers.Clone())
+	if !sameSite(origin.Hostname(), to.Hostname()) {
+		h.Del("Authorization")
+		h.Del("Cookie")
+	}
+	return h
+}
+
+// pinnedHeaders 构建发往固定地址（或镜像）的请求头：目标地址跨站点时不携带原始请求的Cookie/Authorization
+// （例如registry的Bearer token不应发给CDN，签名地址也会因为多余的鉴权头被拒绝）
+func pinnedHeaders(Headers http.Header, bag ChunkBag, usedURL string) http.Header {
+	if bag.Pin == nil && usedURL == bag.TargetURL {
+		return ReqH1ToH2Headers(Headers.Clone())
+	}
+	origin, err1 := url.Parse(bag.OriginURL())
+	to, err2 := url.Parse(usedURL)
+	if err1 != nil || err2 != nil {
+		h := ReqH1ToH2Headers(Headers.Clone())
+		h.Del("Authorization")
+		h.Del("Cookie")
+		return h
+	}
+	return redirectHeaders(Headers, origin, to)
+}
+
+// sameSite 目标是原始Host本身或其子域名
+func sameSite(origin string, to string) bool {
+	origin = strings.ToLower(origin)
+	to = strings.ToLower(to)
+	return to == origin || strings.HasSuffix(to, "."+origin)
+}
+
+// isExpiredStatus 签名地址过期时常见的状态码
+func isExpiredStatus(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden || code == http.StatusGone
+}
+
+// checkPinnedExpired 分块请求在固定地址上被拒绝时重新解析地址，并返回可重试错误让分块重新下载
+func checkPinnedExpired(ctx context.Context, resp *http.Response, bag ChunkBag, usedURL string) error {
+	if bag.Pin == nil || !isExpiredStatus(resp.StatusCode) {
+		return nil
+	}
+	if err := bag.Pin.Reresolve(ctx, usedURL); err != nil {
+		return fmt.Errorf("re-resolve redirect failed: %w", err)
+	}
+	return fmt.Errorf("retryable: pinned URL rejected with status %d, re-resolved", resp.StatusCode)
+}
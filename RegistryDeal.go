@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// OCI/Docker registry 镜像层下载：GET /v2/<name>/blobs/sha256:<hex>
+// 鉴权(Bearer token)由客户端完成并原样转发给registry；registry返回的307跳转到CDN时由重定向逻辑解析，
+// token不会被带到CDN；分块重组后的内容按URL中的digest做sha256校验
+
+const BlobExceedSize = 16 * 1024 * 1024 // 镜像层普遍小于 ExceedSize，单独使用更低的分块阈值
+
+var blobPathRe = regexp.MustCompile(`^/v2/(.+)/blobs/(sha256:[a-f0-9]{64})$`)
+
+// RegistryBlobDigest 判断是否为registry镜像层请求，返回URL中的digest
+func RegistryBlobDigest(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	m := blobPathRe.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return "", false
+	}
+	return m[2], true
+}
+
+// ChunkThreshold 请求触发分块加速的文件大小阈值
+func ChunkThreshold(r *http.Request) int64 {
+	if _, ok := RegistryBlobDigest(r); ok {
+		return BlobExceedSize
+	}
+	return ExceedSize
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 按网卡的DNS解析：每张网卡可以使用自己的DNS服务器（UDP/TCP绑定该网卡的源地址）或DoH，
+// 双运营商环境下第二张网卡不会拿到为第一家运营商选择的CDN节点
+// 优先级：策略中Host的 ResolveTo 固定地址 > Host的 DNS/DoH > 网卡配置 > 系统解析
+
+const (
+	DNSTimeout    = 3 * time.Second
+	DNSMinTTL     = 5 * time.Second
+	DNSMaxTTL     = 1 * time.Hour
+	DNSSystemTTL  = 60 * time.Second // 系统解析拿不到TTL时的缓存时长
+	DNSUDPSize    = 1232
+	DNSMaxMsgSize = 65535
+)
+
+var errDNSTruncated = errors.New("dns response truncated")
+
+// ResolverConf 一次查询使用的解析方式，零值表示系统解析
+type ResolverConf struct {
+	Servers []string
+	TCP     bool
+	DoH     string
+}
+
+func (c ResolverConf) IsSystem() bool {
+	return len(c.Servers) == 0 && c.DoH == ""
+}
+
+type dnsCacheEntry struct {
+	IPs     []net.IP
+	Expires time.Time
+}
+
+// DNSCache 所有网卡共用的解析缓存，key 为 网卡IP|Host，遵守记录的TTL
+type DNSCache struct {
+	mu      sync.RWMutex
+	content map[string]dnsCacheEntry
+}
+
+var GloDNSCache = &DNSCache{
+	content: make(map[string]dnsCacheEntry),
+}
+
+func (c *DNSCache) Get(key string) ([]net.IP, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.content[key]
+	if !ok || time.Now().After(entry.Expires) {
+		return nil, false
+	}
+	return entry.IPs, true
+}
+func (c *DNSCache) Set(key string, IPs []net.IP, ttl time.Duration) {
+	ttl = min(max(ttl, DNSMinTTL), DNSMaxTTL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.content[key] = dnsCacheEntry{IPs: IPs, Expires: time.Now().Add(ttl)}
+}
+
+// resolverConfFor 选择Host在该网卡上的解析方式
+func resolverConfFor(LocalIP string, rule HostRule) ResolverConf {
+	if len(rule.DNS) > 0 || rule.DoH != "" {
+		return ResolverConf{Servers: rule.DNS, DoH: rule.DoH}
+	}
+	conf := GloNetCardConfig.CheckCard(LocalIP)
+	return ResolverConf{Servers: conf.DNS, TCP: conf.DNSOverTCP, DoH: conf.DoH}
+}
+
+// LookupNIC 经指定网卡解析Host的全部地址（A在前，AAAA在后）
+func LookupNIC(ctx context.Context, LocalIP string, host string) ([]net.IP, error) {
+	if IP := net.ParseIP(host); IP != nil {
+		return []net.IP{IP}, nil
+	}
+	rule := GlobalPolicyManager.CheckRule(host)
+	if len(rule.ResolveTo) > 0 {
+		var IPs []net.IP
+		for _, s := range rule.ResolveTo {
+			if IP := net.ParseIP(s); IP != nil {
+				IPs = append(IPs, IP)
+			}
+		}
+		if len(IPs) > 0 {
+			return IPs, nil
+		}
+	}
+	key := LocalIP + "|" + host
+	if IPs, ok := GloDNSCache.Get(key); ok {
+		return IPs, nil
+	}
+	conf := resolverConfFor(LocalIP, rule)
+	if conf.IsSystem() {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var IPs []net.IP
+		for _, addr := range addrs {
+			IPs = append(IPs, addr.IP)
+		}
+		GloDNSCache.Set(key, IPs, DNSSystemTTL)
+		return IPs, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DNSTimeout)
+	defer cancel()
+	type answer struct {
+		IPs []net.IP
+		TTL time.Duration
+		Err error
+	}
+	var v4, v6 answer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		v4.IPs, v4.TTL, v4.Err = queryNIC(ctx, LocalIP, conf, host, dnsmessage.TypeA)
+	}()
+	go func() {
+		defer wg.Done()
+		v6.IPs, v6.TTL, v6.Err = queryNIC(ctx, LocalIP, conf, host, dnsmessage.TypeAAAA)
+	}()
+	wg.Wait()
+	IPs := append(v4.IPs, v6.IPs...)
+	if len(IPs) == 0 {
+		if v4.Err != nil {
+			return nil, fmt.Errorf("resolve %s via %s: %w", host, LocalIP, v4.Err)
+		}
+		return nil, fmt.Errorf("resolve %s via %s: no address", host, LocalIP)
+	}
+	ttl := DNSMaxTTL
+	for _, a := range []answer{v4, v6} {
+		if len(a.IPs) > 0 && a.TTL < ttl {
+			ttl = a.TTL
+		}
+	}
+	GloDNSCache.Set(key, IPs, ttl)
+	return IPs, nil
+}
+
+// queryNIC 按配置依次尝试 DoH / 各个DNS服务器
+func queryNIC(ctx context.Context, LocalIP string, conf ResolverConf, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	query, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastErr error
+	if conf.DoH != "" {
+		resp, err := exchangeDoH(ctx, LocalIP, conf.DoH, query)
+		if err == nil {
+			// DoH 请求ID为0，这里不校验ID
+			return parseAnswer(resp, 0, qtype, false)
+		}
+		lastErr = err
+	}
+	for _, server := range conf.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		var resp []byte
+		if !conf.TCP {
+			resp, err = exchangeDNS(ctx, LocalIP, "udp", server, query)
+			if err == nil {
+				IPs, ttl, err := parseAnswer(resp, id, qtype, true)
+				if !errors.Is(err, errDNSTruncated) {
+					if err == nil {
+						return IPs, ttl, nil
+					}
+					lastErr = err
+					continue
+				}
+			}
+		}
+		resp, err = exchangeDNS(ctx, LocalIP, "tcp", server, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		IPs, ttl, err := parseAnswer(resp, id, qtype, true)
+		if err == nil {
+			return IPs, ttl, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no dns server configured")
+	}
+	return nil, 0, lastErr
+}
+
+func buildQuery(id uint16, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(DNSUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// exchangeDNS 经网卡源地址发送查询；TCP 使用2字节长度前缀
+func exchangeDNS(ctx context.Context, LocalIP string, network string, server string, query []byte) ([]byte, error) {
+	// DNS服务器与网卡地址族不一致时改用同网卡的另一地址
+	source := LocalIP
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		if IP := net.ParseIP(host); IP != nil {
+			source = sourceFor(LocalIP, IP)
+		}
+	}
+	dialer := withSource(&net.Dialer{Control: BindControl(source)}, network, source)
+	conn, err := countConn(dialer.DialContext(ctx, network, server))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, DNSUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+var dohClients sync.Map // 网卡IP -> *http.Client
+
+// dohClient DoH 请求同样绑定网卡；DoH服务器地址本身使用系统解析（建议直接写IP）
+func dohClient(LocalIP string) *http.Client {
+	if c, ok := dohClients.Load(LocalIP); ok {
+		return c.(*http.Client)
+	}
+	dialer := &net.Dialer{
+		Timeout:   DNSTimeout,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(LocalIP)},
+		Control:   BindControl(LocalIP),
+	}
+	transport := &http.Transport{
+		DialContext: countedDial(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			// DoH服务器写成IP且地址族不一致时改用同网卡的另一地址
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				if IP := net.ParseIP(host); IP != nil {
+					return withSource(dialer, network, sourceFor(LocalIP, IP)).DialContext(ctx, network, addr)
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}),
+		TLSClientConfig:     &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(16)},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     120 * time.Second,
+	}
+	actual, _ := dohClients.LoadOrStore(LocalIP, &http.Client{Transport: transport, Timeout: DNSTimeout})
+	return actual.(*http.Client)
+}
+
+// exchangeDoH RFC 8484 POST application/dns-message
+func exchangeDoH(ctx context.Context, LocalIP string, endpoint string, query []byte) ([]byte, error) {
+	// DoH 推荐ID为0，便于HTTP缓存
+	msg := append([]byte{}, query...)
+	msg[0], msg[1] = 0, 0
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := dohClient(LocalIP).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, DNSMaxMsgSize))
+}
+
+// parseAnswer 取出回答中的 A/AAAA 记录（包括CNAME链末端），TTL取最小值
+func parseAnswer(msg []byte, id uint16, qtype dnsmessage.Type, checkID bool) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if checkID && h.ID != id {
+		return nil, 0, fmt.Errorf("dns id mismatch")
+	}
+	if h.Truncated {
+		return nil, 0, errDNSTruncated
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("dns rcode %v", h.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var IPs []net.IP
+	ttl := DNSMaxTTL
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if rh.Type != qtype {
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		switch qtype {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			IPs = append(IPs, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			IPs = append(IPs, net.IP(r.AAAA[:]))
+		}
+		if t := time.Duration(rh.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return IPs, ttl, nil
+}
+
+// ========== 拨号 ==========
+
+// sameFamily 过滤出与网卡地址族一致的地址
+func sameFamily(LocalIP string, IPs []net.IP) []net.IP {
+	localV4 := net.ParseIP(LocalIP).To4() != nil
+	var usable []net.IP
+	for _, IP := range IPs {
+		if (IP.To4() != nil) == localV4 {
+			usable = append(usable, IP)
+		}
+	}
+	return usable
+}
+
+// NICDialContext 经网卡解析后拨号，在本地址族与同网卡另一地址族之间做 Happy Eyeballs
+func NICDialContext(LocalIP string, dialer *net.Dialer) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return countedDial(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		if IP := net.ParseIP(host); IP != nil {
+			return withSource(dialer, network, sourceFor(LocalIP, IP)).DialContext(ctx, network, addr)
+		}
+		IPs, err := LookupNIC(ctx, LocalIP, host)
+		if err != nil {
+			return nil, err
+		}
+		primary := dialPlan{dialer: dialer, IPs: sameFamily(LocalIP, IPs)}
+		var fallback dialPlan
+		if sib := GloSiblings.Sibling(LocalIP); sib != "" {
+			fallback = dialPlan{dialer: withSource(dialer, network, sib), IPs: sameFamily(sib, IPs)}
+		}
+		if len(primary.IPs) == 0 && len(fallback.IPs) == 0 {
+			return nil, fmt.Errorf("no address of %s reachable from %s", host, LocalIP)
+		}
+		return dialHappyEyeballs(ctx, network, port, primary, fallback)
+	})
+}
+
+// DialPassThrough 直通转发的拨号：默认与原来一样走系统路由与系统解析（内网、只能经其他网卡到达的地址不受影响）；
+// 策略规则为该Host指定了解析（ResolveTo/DNS/DoH）或当前最优网卡配置了DNS/DoH时，走该网卡并使用对应的解析；
+// 访问认证页面时走被拦截的那张网卡，才能完成登录
+func DialPassThrough(ctx context.Context, addr string) (net.Conn, error) {
+	system := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return countConn(system.DialContext(ctx, "tcp", addr))
+	}
+	IP, ok := GloNICHealth.PortalNIC(host)
+	if !ok {
+		if IP, err = NetCardCho.getBestProbeIP(); err != nil {
+			return countConn(system.DialContext(ctx, "tcp", addr))
+		}
+		rule := GlobalPolicyManager.CheckRule(host)
+		if len(rule.ResolveTo) == 0 && resolverConfFor(IP, rule).IsSystem() {
+			// 系统选择的出口同样计入该网卡的用量
+			return countConn(system.DialContext(ctx, "tcp", addr))
+		}
+	}
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(IP)},
+		Control:   BindControl(IP),
+	}
+	return NICDialContext(IP, dialer)(ctx, "tcp", addr)
+}
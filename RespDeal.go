@@ -1,19 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
-func RespDeal(Header http.Header, StatusCode int) (ifChunks bool, fileSize int64, fileCode int64, err error) {
+func RespDeal(Header http.Header, StatusCode int, threshold int64) (ifChunks bool, fileSize int64, fileCode int64, err error) {
 	switch StatusCode {
 	case http.StatusPartialContent: // 206
 		cr := Header.Get("Content-Range") // 例: "bytes 0-0/207322416" 或 "bytes 0-0/*"
-		if partSize, _, ok := parseContentRangeTotal(cr); ok {
+		if totalSize, _, ok := parseContentRangeTotal(cr); ok {
 			//fmt.Printf("Are you bibi?\n")
-			fileSize = partSize
+			fileSize = totalSize
 			fileCode = http.StatusPartialContent
 			return false, fileSize, fileCode, nil
 		} else {
@@ -34,7 +35,7 @@ func RespDeal(Header http.Header, StatusCode int) (ifChunks bool, fileSize int64
 		if cl := headerInt(contentLength); cl >= 0 {
 			fileSize = cl
 			fileCode = http.StatusOK
-			if fileSize >= ExceedSize && acceptRanges == "bytes" { // 这里还要判断能否进行range?
+			if fileSize >= threshold && acceptRanges == "bytes" { // 这里还要判断能否进行range?
 				//fmt.Printf("Are you OK?\n")
 				return true, fileSize, fileCode, nil
 			} else {
@@ -49,48 +50,13 @@ func RespDeal(Header http.Header, StatusCode int) (ifChunks bool, fileSize int64
 
 // 统一解析 Content-Range 的 total：
 // 兼容 "bytes 0-0/207322416"（206）与 "bytes */207322416"（416）
-func parseContentRangeTotal(cr string) (partSize int64, totalSize int64, ok bool) {
-	cr = strings.TrimSpace(cr) // 去掉空格换行
-	if cr == "" {
-		return -1, -1, false
+// 成功时返回 (总大小, 本次返回的字节数, true)；没有起止位置（如416）时返回 (-1, 总大小, false)
+func parseContentRangeTotal(cr string) (totalSize int64, partSize int64, ok bool) {
+	start, end, total, ok := parseContentRange(cr)
+	if !ok {
+		return -1, total, false
 	}
-	lc := strings.ToLower(cr) // 判断是否由byte
-	if !strings.HasPrefix(lc, "byte") {
-		return -1, -1, false
-	}
-	// 去掉 byte
-	rangeStr := strings.TrimSpace(cr[6:])
-
-	slashPos := strings.LastIndexByte(rangeStr, '/')
-	if slashPos < 0 {
-		return -1, -1, false
-	}
-	rangePart := strings.TrimSpace(rangeStr[:slashPos])
-	totalPart := strings.TrimSpace(rangeStr[slashPos+1:])
-
-	// 解析总文件大小
-	totalSize = -1
-	if totalPart != "*" {
-		if total, err := strconv.ParseInt(totalPart, 10, 64); err == nil && total >= 0 {
-			totalSize = total
-		}
-	}
-	// 解析range部分: "36700160-41943039"
-	dashPos := strings.IndexByte(rangePart, '-')
-	if dashPos < 0 {
-		return -1, totalSize, false
-	}
-	startStr := strings.TrimSpace(rangePart[:dashPos]) // "36700160"
-	endStr := strings.TrimSpace(rangePart[dashPos+1:]) // "41943039"
-	start, err1 := strconv.ParseInt(startStr, 10, 64)
-	end, err2 := strconv.ParseInt(endStr, 10, 64)
-	if err1 != nil || err2 != nil || start > end {
-		return -1, totalSize, false
-	}
-
-	// 计算实际接收的数据大小
-	actualSize := end - start + 1 // 41943039 - 36700160 + 1 = 5242880字节
-	return totalSize, actualSize, true
+	return total, end - start + 1, true
 }
 
 func headerInt(s string) int64 {
@@ -103,3 +69,62 @@ func headerInt(s string) int64 {
 	}
 	return n
 }
+
+// ErrChunkMismatch 分块响应与预期不一致（服务器忽略Range、CDN节点文件版本不同等），需要降级为单流传输
+var ErrChunkMismatch = errors.New("chunk response mismatch")
+
+// ErrChunkVersion 分块响应的文件版本（总大小、ETag、Last-Modified）与首个响应不同，属于 ErrChunkMismatch
+var ErrChunkVersion = fmt.Errorf("%w: version changed", ErrChunkMismatch)
+
+// CheckChunkResp 校验分块响应：必须是206，Content-Range的起止与总大小要和任务一致，ETag/Last-Modified不能变化
+func CheckChunkResp(resp *http.Response, task ChunkTask, bag ChunkBag) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%w: chunk %d status %d", ErrChunkMismatch, task.Index, resp.StatusCode)
+	}
+	cr := resp.Header.Get("Content-Range")
+	start, end, total, ok := parseContentRange(cr)
+	if !ok || start != task.Start || end != task.End {
+		return fmt.Errorf("%w: chunk %d want bytes %d-%d, got %q", ErrChunkMismatch, task.Index, task.Start, task.End, cr)
+	}
+	if total >= 0 && bag.AllBytes > 0 && total != bag.AllBytes {
+		return fmt.Errorf("%w: chunk %d total size %d, want %d", ErrChunkVersion, task.Index, total, bag.AllBytes)
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != end-start+1 {
+		return fmt.Errorf("%w: chunk %d Content-Length %d, want %d", ErrChunkMismatch, task.Index, resp.ContentLength, end-start+1)
+	}
+	if !bag.SameVersion(resp.Header) {
+		return fmt.Errorf("%w: chunk %d validator changed (ETag %q, Last-Modified %q)", ErrChunkVersion, task.Index, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	}
+	return nil
+}
+
+// parseContentRange 解析 "bytes 0-1023/4096"，返回起止位置与总大小（总大小为 "*" 时为-1）
+// "bytes */4096" 没有起止位置，ok 为 false，但仍返回总大小
+func parseContentRange(cr string) (start int64, end int64, total int64, ok bool) {
+	cr = strings.TrimSpace(cr)
+	if len(cr) < 6 || !strings.EqualFold(cr[:5], "bytes") || (cr[5] != ' ' && cr[5] != '\t') {
+		return -1, -1, -1, false
+	}
+	rangePart, totalPart, found := strings.Cut(strings.TrimSpace(cr[6:]), "/")
+	if !found {
+		return -1, -1, -1, false
+	}
+	total = -1
+	if totalPart = strings.TrimSpace(totalPart); totalPart != "*" {
+		n, err := strconv.ParseInt(totalPart, 10, 64)
+		if err != nil || n < 0 {
+			return -1, -1, -1, false
+		}
+		total = n
+	}
+	startStr, endStr, found := strings.Cut(strings.TrimSpace(rangePart), "-")
+	if !found {
+		return -1, -1, total, false
+	}
+	start, err1 := strconv.ParseInt(strings.TrimSpace(startStr), 10, 64)
+	end, err2 := strconv.ParseInt(strings.TrimSpace(endStr), 10, 64)
+	if err1 != nil || err2 != nil || start > end || (total >= 0 && end >= total) {
+		return -1, -1, total, false
+	}
+	return start, end, total, true
+}
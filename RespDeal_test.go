@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in                string
+		start, end, total int64
+		ok                bool
+	}{
+		{"bytes 0-1023/4096", 0, 1023, 4096, true},
+		{"bytes 1024-4095/4096", 1024, 4095, 4096, true},
+		{"Bytes\t0-0/1", 0, 0, 1, true},
+		{"  bytes  10-19 / 100 ", 10, 19, 100, true},
+		{"bytes 0-99/*", 0, 99, -1, true},
+		{"bytes */4096", -1, -1, 4096, false},
+		{"bytes 0-4096/4096", -1, -1, 4096, false}, // 结束位置越界
+		{"bytes 20-10/100", -1, -1, 100, false},    // 起止颠倒
+		{"bytes 0-10", -1, -1, -1, false},          // 缺少总大小
+		{"bytes 0-10/abc", -1, -1, -1, false},
+		{"bytes 0-10/-1", -1, -1, -1, false},
+		{"bytes a-10/100", -1, -1, 100, false},
+		{"bytes 0-/100", -1, -1, 100, false},
+		{"bytes=0-10/100", -1, -1, -1, false},
+		{"items 0-10/100", -1, -1, -1, false},
+		{"bytes", -1, -1, -1, false},
+		{"", -1, -1, -1, false},
+	}
+	for _, tt := range tests {
+		start, end, total, ok := parseContentRange(tt.in)
+		if start != tt.start || end != tt.end || total != tt.total || ok != tt.ok {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v; want %d, %d, %d, %v",
+				tt.in, start, end, total, ok, tt.start, tt.end, tt.total, tt.ok)
+		}
+	}
+}
+
+func TestParseContentRangeTotal(t *testing.T) {
+	tests := []struct {
+		in          string
+		total, part int64
+		ok          bool
+	}{
+		{"bytes 0-0/4096", 4096, 1, true},
+		{"bytes 0-99/*", -1, 100, true},
+		{"bytes */4096", -1, 4096, false},
+		{"garbage", -1, -1, false},
+	}
+	for _, tt := range tests {
+		total, part, ok := parseContentRangeTotal(tt.in)
+		if total != tt.total || part != tt.part || ok != tt.ok {
+			t.Errorf("parseContentRangeTotal(%q) = %d, %d, %v; want %d, %d, %v", tt.in, total, part, ok, tt.total, tt.part, tt.ok)
+		}
+	}
+}
+
+func TestCheckChunkResp(t *testing.T) {
+	bag := ChunkBag{AllBytes: 4096, ETag: `"v1"`, LastModified: "Mon, 19 Oct 2026 00:00:00 GMT"}
+	task := ChunkTask{Index: 1, Start: 1024, End: 2047}
+	resp := func(status int, cr string, length int64, etag string) *http.Response {
+		h := http.Header{}
+		if cr != "" {
+			h.Set("Content-Range", cr)
+		}
+		if etag != "" {
+			h.Set("ETag", etag)
+		}
+		return &http.Response{StatusCode: status, Header: h, ContentLength: length}
+	}
+	tests := []struct {
+		name string
+		resp *http.Response
+		want error
+	}{
+		{"ok", resp(206, "bytes 1024-2047/4096", 1024, `"v1"`), nil},
+		{"weak etag", resp(206, "bytes 1024-2047/4096", 1024, `W/"v1"`), nil},
+		{"unknown total", resp(206, "bytes 1024-2047/*", -1, ""), nil},
+		{"range ignored", resp(200, "", 4096, `"v1"`), ErrChunkMismatch},
+		{"wrong range", resp(206, "bytes 0-1023/4096", 1024, `"v1"`), ErrChunkMismatch},
+		{"malformed", resp(206, "bytes 1024-2047", 1024, `"v1"`), ErrChunkMismatch},
+		{"short body", resp(206, "bytes 1024-2047/4096", 100, `"v1"`), ErrChunkMismatch},
+		{"size changed", resp(206, "bytes 1024-2047/8192", 1024, `"v1"`), ErrChunkVersion},
+		{"etag changed", resp(206, "bytes 1024-2047/4096", 1024, `"v2"`), ErrChunkVersion},
+	}
+	for _, tt := range tests {
+		err := CheckChunkResp(tt.resp, task, bag)
+		switch {
+		case tt.want == nil && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.want != nil && !errors.Is(err, tt.want):
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.want)
+		case tt.want == ErrChunkMismatch && errors.Is(err, ErrChunkVersion):
+			t.Errorf("%s: %v should not be a version mismatch", tt.name, err)
+		}
+	}
+}
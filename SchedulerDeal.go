@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// 调度器：根据各网卡/各连接的吞吐样本生成 NetCardHTTPCho 快照（Probe与分块的选择概率），并据此规划分块
+// PeriodCheck 每个周期把样本交给所有调度器，各自的快照分别保存；分块规划按策略规则中 Scheduler 选择
+// NetCardCho.current 始终是默认调度器（ewma）的快照，Probe选择、失败改派等沿用它
+
+const DefaultScheduler = "ewma"
+
+// CardSample 一个周期内单张网卡的样本
+type CardSample struct {
+	IP            string
+	StandardSpeed float64   // 网卡容量估计 MB/s
+	NowSpeed      float64   // 当前总速度 MB/s
+	Speeds        []float64 // [0] 为Probe，其后依次为各分块连接的速度 MB/s
+	Outstanding   []int64   // 各分块连接上尚未完成的字节数
+}
+
+type Scheduler interface {
+	Name() string
+	// Snapshot 由本周期样本生成选择概率
+	Snapshot(cards []CardSample) *NetCardHTTPCho
+	// Plan 根据快照把整个文件切成分块任务
+	Plan(snapshot *NetCardHTTPCho, AllSize int64) ([]ChunkTask, error)
+}
+
+var schedulers = map[string]Scheduler{
+	"ewma":     &EWMAScheduler{},
+	"wrr":      &WRRScheduler{},
+	"lob":      &LeastOutstandingScheduler{},
+	"thompson": NewThompsonScheduler(),
+}
+
+// SchedulerFor 获取Host使用的调度器，未配置或名称无效时使用当前配置方案的调度器，再次为默认调度器
+func SchedulerFor(host string) Scheduler {
+	if s, ok := schedulers[GlobalPolicyManager.CheckRule(host).Scheduler]; ok {
+		return s
+	}
+	if s, ok := schedulers[GloProfiles.Scheduler()]; ok {
+		return s
+	}
+	return schedulers[DefaultScheduler]
+}
+
+// PublishSnapshots 由所有调度器生成快照并发布
+func (p *NetHTTPCho) PublishSnapshots(cards []CardSample) {
+	for name, s := range schedulers {
+		snapshot := s.Snapshot(cards)
+		p.byScheduler.Store(name, snapshot)
+		if name == DefaultScheduler {
+			p.current.Store(snapshot)
+		}
+	}
+}
+
+// ForgetSchedulers 网卡被移除或连接数变化时清除调度器中该网卡的状态
+func ForgetSchedulers(IP string) {
+	for _, s := range schedulers {
+		if f, ok := s.(interface{ Forget(IP string) }); ok {
+			f.Forget(IP)
+		}
+	}
+}
+
+// SnapshotFor 获取指定调度器的最新快照，还没有生成时使用默认快照
+func (p *NetHTTPCho) SnapshotFor(name string) *NetCardHTTPCho {
+	if v, ok := p.byScheduler.Load(name); ok {
+		return v.(*NetCardHTTPCho)
+	}
+	return p.current.Load()
+}
+
+// bestChunkSize 网卡的分块大小
+func bestChunkSize(IP string) int64 {
+	BestChunkSizeRecorder.mu.RLock()
+	defer BestChunkSizeRecorder.mu.RUnlock()
+	if size := BestChunkSizeRecorder.content[IP]; size > 0 {
+		return size
+	}
+	return 5 * 1024 * 1024
+}
+
+// outstandingBytes 连接上尚未完成的字节数（实时值）
+func outstandingBytes(IP string, index int) int64 {
+	if val, ok := NetCardBytes.content.Load(IP); ok {
+		return val.(*ClientBytes).Outstanding(index)
+	}
+	return 0
+}
+
+// ========== 1. 通用的分块规划 ==========
+
+// planByWeight 按概率把文件切成连续的区间，每个连接负责一段，区间内按网卡分块大小切分
+// 分到的区间不足一个分块的连接（未测速的新网卡、权重很小）不分配，其区间并入下一个连接
+func planByWeight(snapshot *NetCardHTTPCho, AllSize int64) ([]ChunkTask, error) {
+	var chunkTasks []ChunkTask
+	if len(snapshot.ChunksEntries) == 0 {
+		return []ChunkTask{}, fmt.Errorf("chunks no probability available")
+	}
+	fmt.Printf("snapshotChunks: %v\n", snapshot.ChunksEntries)
+	var TaskIndex = 0
+	var AllStartPos int64 = 0.0
+	var AllEndPos int64 = 0.0
+	var AllSizePos = AllSize - 1
+	var TaskSizePos int64
+	var carry int64 // 前面被跳过的连接留下的区间
+	for i, Entry := range snapshot.ChunksEntries {
+		// 还没有样本时平均分配
+		share := 1 / float64(len(snapshot.ChunksEntries))
+		if snapshot.TotalChunks > 0 {
+			share = Entry.ProbNum / snapshot.TotalChunks
+		}
+		TaskSize := int64(share*float64(AllSize)) + carry
+		fmt.Printf("Entry Index%d: TaskSize%d\n", TaskIndex, TaskSize)
+		BestChunk := bestChunkSize(Entry.IP)
+		if i == len(snapshot.ChunksEntries)-1 {
+			if AllStartPos > AllSizePos {
+				break
+			}
+			TaskSizePos = AllSizePos
+		} else if TaskSize < BestChunk {
+			carry = TaskSize
+			continue
+		} else {
+			TaskSizePos = AllStartPos + TaskSize - 1
+		}
+		carry = 0
+		for {
+			if AllStartPos+2*BestChunk-1 <= TaskSizePos {
+				AllEndPos += BestChunk - 1
+				chunkTasks = append(chunkTasks, ChunkTask{Index: TaskIndex, End: AllEndPos, Start: AllStartPos, ClientIP: Entry.IP, ClientIndex: Entry.Index})
+				AllStartPos = AllEndPos + 1
+				AllEndPos = AllStartPos
+				TaskIndex++
+			} else {
+				AllEndPos = TaskSizePos
+				chunkTasks = append(chunkTasks, ChunkTask{Index: TaskIndex, End: AllEndPos, Start: AllStartPos, ClientIP: Entry.IP, ClientIndex: Entry.Index})
+				AllStartPos = AllEndPos + 1
+				AllEndPos = AllStartPos
+				TaskIndex++
+				break
+			}
+		}
+	}
+	return chunkTasks, nil
+}
+
+// planByFinishTime 按文件顺序逐块分配给预计最早完成的连接（已排队字节 / 速率），分块在连接间交错
+func planByFinishTime(entries []ChunksClientEntry, outstanding []int64, AllSize int64) ([]ChunkTask, error) {
+	if len(entries) == 0 {
+		return []ChunkTask{}, fmt.Errorf("chunks no probability available")
+	}
+	load := make([]float64, len(entries))
+	for i := range entries {
+		load[i] = float64(outstanding[i])
+	}
+	var chunkTasks []ChunkTask
+	var start int64
+	for index := 0; start < AllSize; index++ {
+		best, bestFinish := 0, math.Inf(1)
+		for i, Entry := range entries {
+			rate := math.Max(Entry.ProbNum, 1e-6)
+			if finish := (load[i] + float64(bestChunkSize(Entry.IP))) / rate; finish < bestFinish {
+				best, bestFinish = i, finish
+			}
+		}
+		Entry := entries[best]
+		end := min(start+bestChunkSize(Entry.IP), AllSize) - 1
+		chunkTasks = append(chunkTasks, ChunkTask{Index: index, Start: start, End: end, ClientIP: Entry.IP, ClientIndex: Entry.Index})
+		load[best] += float64(end - start + 1)
+		start = end + 1
+	}
+	return chunkTasks, nil
+}
+
+// capacityShare 网卡容量平均到每条分块连接 (MB/s)，还没有测速结果时给一个很小的正数
+func capacityShare(card CardSample) float64 {
+	n := len(card.Speeds) - 1
+	if n <= 0 || card.StandardSpeed <= 0 {
+		return 0.01
+	}
+	return card.StandardSpeed / float64(n)
+}
+
+// ========== 2. EWMA（原有算法） ==========
+
+// EWMAScheduler 以 PeriodCheck 中EWMA维护的网卡容量为基准：网卡可用速度扣除其他连接占用后，该连接越空闲概率越高
+type EWMAScheduler struct{}
+
+func (s *EWMAScheduler) Name() string { return "ewma" }
+
+func (s *EWMAScheduler) Snapshot(cards []CardSample) *NetCardHTTPCho {
+	snapshot := &NetCardHTTPCho{}
+	for _, card := range cards {
+		Base := card.NowSpeed
+		if card.StandardSpeed > card.NowSpeed {
+			Base = card.StandardSpeed
+		}
+		for i, Speed := range card.Speeds {
+			Free := Base - (card.NowSpeed - Speed)
+			P := 0.0
+			if Free > 0 {
+				P = card.StandardSpeed * (1 - Speed/Free) * (1 - Speed/Free)
+			}
+			if i == 0 {
+				snapshot.ProbeEntries = append(snapshot.ProbeEntries, ProbeClientEntry{IP: card.IP, ProbNum: P})
+				snapshot.TotalProbe += P
+			} else {
+				snapshot.ChunksEntries = append(snapshot.ChunksEntries, ChunksClientEntry{IP: card.IP, Index: i - 1, ProbNum: P})
+				snapshot.TotalChunks += P
+			}
+		}
+	}
+	return snapshot
+}
+
+func (s *EWMAScheduler) Plan(snapshot *NetCardHTTPCho, AllSize int64) ([]ChunkTask, error) {
+	return planByWeight(snapshot, AllSize)
+}
+
+// ========== 3. 加权轮询 ==========
+
+// WRRScheduler 只按网卡容量分配权重，不看瞬时负载；分块按平滑加权轮询交错分给各连接
+type WRRScheduler struct{}
+
+func (s *WRRScheduler) Name() string { return "wrr" }
+
+func (s *WRRScheduler) Snapshot(cards []CardSample) *NetCardHTTPCho {
+	snapshot := &NetCardHTTPCho{}
+	for _, card := range cards {
+		share := capacityShare(card)
+		snapshot.ProbeEntries = append(snapshot.ProbeEntries, ProbeClientEntry{IP: card.IP, ProbNum: card.StandardSpeed})
+		snapshot.TotalProbe += card.StandardSpeed
+		for i := 1; i < len(card.Speeds); i++ {
+			snapshot.ChunksEntries = append(snapshot.ChunksEntries, ChunksClientEntry{IP: card.IP, Index: i - 1, ProbNum: share})
+			snapshot.TotalChunks += share
+		}
+	}
+	return snapshot
+}
+
+func (s *WRRScheduler) Plan(snapshot *NetCardHTTPCho, AllSize int64) ([]ChunkTask, error) {
+	entries := snapshot.ChunksEntries
+	if len(entries) == 0 {
+		return []ChunkTask{}, fmt.Errorf("chunks no probability available")
+	}
+	current := make([]float64, len(entries))
+	var chunkTasks []ChunkTask
+	var start int64
+	for index := 0; start < AllSize; index++ {
+		// 平滑加权轮询：每轮所有项加上自身权重，选最大者并减去总权重
+		best := 0
+		for i, Entry := range entries {
+			current[i] += math.Max(Entry.ProbNum, 1e-6)
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= math.Max(snapshot.TotalChunks, 1e-6*float64(len(entries)))
+		Entry := entries[best]
+		end := min(start+bestChunkSize(Entry.IP), AllSize) - 1
+		chunkTasks = append(chunkTasks, ChunkTask{Index: index, Start: start, End: end, ClientIP: Entry.IP, ClientIndex: Entry.Index})
+		start = end + 1
+	}
+	return chunkTasks, nil
+}
+
+// ========== 4. 最少未完成字节 ==========
+
+// LeastOutstandingScheduler 概率与连接上排队的字节数成反比；规划时把每块分给预计最早完成的连接
+type LeastOutstandingScheduler struct{}
+
+func (s *LeastOutstandingScheduler) Name() string { return "lob" }
+
+func (s *LeastOutstandingScheduler) Snapshot(cards []CardSample) *NetCardHTTPCho {
+	snapshot := &NetCardHTTPCho{}
+	for _, card := range cards {
+		share := capacityShare(card)
+		var total int64
+		for i := 1; i < len(card.Speeds); i++ {
+			// 排队1MB相当于权重减半
+			P := share / (1 + float64(card.Outstanding[i-1])/(1024*1024))
+			snapshot.ChunksEntries = append(snapshot.ChunksEntries, ChunksClientEntry{IP: card.IP, Index: i - 1, ProbNum: P})
+			snapshot.TotalChunks += P
+			total += card.Outstanding[i-1]
+		}
+		P := card.StandardSpeed / (1 + float64(total)/(1024*1024))
+		snapshot.ProbeEntries = append(snapshot.ProbeEntries, ProbeClientEntry{IP: card.IP, ProbNum: P})
+		snapshot.TotalProbe += P
+	}
+	return snapshot
+}
+
+func (s *LeastOutstandingScheduler) Plan(snapshot *NetCardHTTPCho, AllSize int64) ([]ChunkTask, error) {
+	// 规划时按容量计算完成时间，排队字节取实时值
+	entries := make([]ChunksClientEntry, len(snapshot.ChunksEntries))
+	outstanding := make([]int64, len(entries))
+	for i, Entry := range snapshot.ChunksEntries {
+		outstanding[i] = outstandingBytes(Entry.IP, Entry.Index)
+		Entry.ProbNum = Entry.ProbNum * (1 + float64(outstanding[i])/(1024*1024))
+		entries[i] = Entry
+	}
+	return planByFinishTime(entries, outstanding, AllSize)
+}
+
+// ========== 5. Thompson 采样 ==========
+
+// ThompsonScheduler 把每条连接的速度看作正态分布，维护均值/方差的在线估计，
+// 每次从后验中采样作为权重：样本少的连接方差大，会被不时尝试（探索），稳定快的连接多数时间胜出（利用）
+type ThompsonScheduler struct {
+	mu    sync.Mutex
+	stats map[string]*speedStat
+}
+
+type speedStat struct {
+	n    float64
+	mean float64
+	m2   float64
+}
+
+func NewThompsonScheduler() *ThompsonScheduler {
+	return &ThompsonScheduler{stats: make(map[string]*speedStat)}
+}
+
+func (s *ThompsonScheduler) Name() string { return "thompson" }
+
+// Forget 清除网卡各连接的后验，网卡回来后重新探索
+func (s *ThompsonScheduler) Forget(IP string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := IP + "#"
+	for key := range s.stats {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.stats, key)
+		}
+	}
+}
+
+// draw 从后验采样；没有样本时以网卡容量均分值为先验均值和标准差
+func (s *ThompsonScheduler) draw(key string, prior float64) float64 {
+	stat, ok := s.stats[key]
+	mean, std := prior, prior
+	if ok && stat.n > 0 {
+		mean = stat.mean
+		variance := prior * prior
+		if stat.n > 1 {
+			variance = stat.m2 / (stat.n - 1)
+		}
+		std = math.Sqrt(variance / stat.n)
+	}
+	return math.Max(mean+std*rand.NormFloat64(), prior*0.01)
+}
+
+func (s *ThompsonScheduler) Snapshot(cards []CardSample) *NetCardHTTPCho {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := &NetCardHTTPCho{}
+	for _, card := range cards {
+		share := capacityShare(card)
+		for i, Speed := range card.Speeds {
+			key := fmt.Sprintf("%s#%d", card.IP, i)
+			// 只有在传输时的速度才是有效样本
+			if Speed > 0.01 {
+				stat, ok := s.stats[key]
+				if !ok {
+					stat = &speedStat{}
+					s.stats[key] = stat
+				}
+				stat.n++
+				delta := Speed - stat.mean
+				stat.mean += delta / stat.n
+				stat.m2 += delta * (Speed - stat.mean)
+			}
+			P := s.draw(key, share)
+			if i == 0 {
+				snapshot.ProbeEntries = append(snapshot.ProbeEntries, ProbeClientEntry{IP: card.IP, ProbNum: P})
+				snapshot.TotalProbe += P
+			} else {
+				snapshot.ChunksEntries = append(snapshot.ChunksEntries, ChunksClientEntry{IP: card.IP, Index: i - 1, ProbNum: P})
+				snapshot.TotalChunks += P
+			}
+		}
+	}
+	return snapshot
+}
+
+func (s *ThompsonScheduler) Plan(snapshot *NetCardHTTPCho, AllSize int64) ([]ChunkTask, error) {
+	// 每次规划重新采样，同一周期内的多个下载也会得到不同的探索
+	s.mu.Lock()
+	entries := make([]ChunksClientEntry, len(snapshot.ChunksEntries))
+	outstanding := make([]int64, len(entries))
+	for i, Entry := range snapshot.ChunksEntries {
+		Entry.ProbNum = s.draw(fmt.Sprintf("%s#%d", Entry.IP, Entry.Index+1), math.Max(Entry.ProbNum, 0.01))
+		entries[i] = Entry
+		outstanding[i] = outstandingBytes(Entry.IP, Entry.Index)
+	}
+	s.mu.Unlock()
+	return planByFinishTime(entries, outstanding, AllSize)
+}
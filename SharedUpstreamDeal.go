@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 共享上游检测：接在同一台路由器上的两张网卡不会带来额外带宽，调度器在它们之间拆分只会增加开销
+// 先经各网卡获取公网出口IP（回显URL 或 STUN）与网关MAC，标识相同的网卡作为候选，
+// 再做一次短时的相关性测速：单独测速之和远大于同时测速的总和时，判定为共享同一瓶颈；
+// 测速无效（或成员是计费网卡不参与测速）时只有公网IP与网关MAC都相同才判定为共享
+// NetCardConfig.json 中 CollapseShared 为 true 时，同组只保留最快的一张参与调度
+
+const (
+	STUNTimeout          = 3 * time.Second
+	CorrelatedTestTime   = 3 * time.Second
+	SharedGainThreshold  = 0.3 // 同时测速相对单独最快者的增益，不足独立链路预期增益的该比例即判为共享
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingResponse  = 0x0101
+	stunXorMappedAddress = 0x0020
+	stunMappedAddress    = 0x0001
+)
+
+// UpstreamInfo 网卡的上游标识
+type UpstreamInfo struct {
+	PublicIP   string
+	GatewayMAC string
+}
+
+type SharedUpstreamDetector struct {
+	mu     sync.RWMutex
+	info   map[string]UpstreamInfo
+	groups map[string][]string // 网卡IP -> 同组的其他网卡
+	reason map[string]string
+}
+
+var GloSharedUpstream = &SharedUpstreamDetector{
+	info:   make(map[string]UpstreamInfo),
+	groups: make(map[string][]string),
+	reason: make(map[string]string),
+}
+
+// Info 网卡的上游标识与共享同一上游的其他网卡
+func (s *SharedUpstreamDetector) Info(IP string) (UpstreamInfo, []string, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.info[IP], s.groups[IP], s.reason[IP]
+}
+
+// Detect 重新检测所有网卡，结果整体替换
+func (s *SharedUpstreamDetector) Detect(ctx context.Context) {
+	NetCardClient.mu.RLock()
+	IPs := make([]string, 0, len(NetCardClient.Content))
+	for IP := range NetCardClient.Content {
+		IPs = append(IPs, IP)
+	}
+	NetCardClient.mu.RUnlock()
+	sort.Strings(IPs)
+
+	info := make(map[string]UpstreamInfo)
+	for _, IP := range IPs {
+		publicIP, err := egressIP(ctx, IP)
+		if err != nil {
+			fmt.Printf("网卡<%s>获取公网出口失败: %v\n", IP, err)
+		}
+		info[IP] = UpstreamInfo{PublicIP: publicIP, GatewayMAC: gatewayMAC(interfaceNameFor(IP))}
+		fmt.Printf("网卡<%s>公网出口: %q, 网关MAC: %q\n", IP, info[IP].PublicIP, info[IP].GatewayMAC)
+	}
+
+	// 标识相同的网卡作为候选组；同一网卡的v4/v6路径本来就是同一条链路，不参与比较
+	byKey := make(map[string][]string)
+	names := make(map[string]map[string]bool)
+	add := func(key string, IP string) {
+		name := interfaceNameFor(IP)
+		if names[key] == nil {
+			names[key] = make(map[string]bool)
+		}
+		if names[key][name] {
+			return
+		}
+		names[key][name] = true
+		byKey[key] = append(byKey[key], IP)
+	}
+	for _, IP := range IPs {
+		if v := info[IP].PublicIP; v != "" {
+			add("ip|"+v, IP)
+		}
+		if v := info[IP].GatewayMAC; v != "" {
+			add("mac|"+v, IP)
+		}
+	}
+	groups := make(map[string][]string)
+	reason := make(map[string]string)
+	tested := make(map[string]bool)
+	for key, members := range byKey {
+		if len(members) < 2 || tested[strings.Join(members, ",")] {
+			continue
+		}
+		tested[strings.Join(members, ",")] = true
+		shared, conclusive, evidence := correlatedTest(ctx, members)
+		if !conclusive {
+			if sameIdentity(members, info) {
+				shared, evidence = true, evidence+"，公网IP与网关MAC均相同"
+			} else {
+				fmt.Printf("网卡 %v 标识相同但无法判定是否共享: %s\n", members, evidence)
+				continue
+			}
+		}
+		evidence = strings.TrimPrefix(strings.TrimPrefix(key, "ip|"), "mac|") + " 相同; " + evidence
+		if !shared {
+			fmt.Printf("网卡 %v 标识相同但测速显示相互独立: %s\n", members, evidence)
+			continue
+		}
+		fmt.Printf("⚠️ 网卡 %v 共享同一上游: %s\n", members, evidence)
+		for _, IP := range members {
+			for _, other := range members {
+				if other != IP && !contains(groups[IP], other) {
+					groups[IP] = append(groups[IP], other)
+				}
+			}
+			reason[IP] = evidence
+		}
+	}
+
+	s.mu.Lock()
+	s.info = info
+	s.groups = groups
+	s.reason = reason
+	s.mu.Unlock()
+}
+
+// sameIdentity 所有成员的公网IP与网关MAC都已知且相同
+func sameIdentity(members []string, info map[string]UpstreamInfo) bool {
+	first := info[members[0]]
+	if first.PublicIP == "" || first.GatewayMAC == "" {
+		return false
+	}
+	for _, IP := range members[1:] {
+		if info[IP] != first {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// collapseShared 开启 CollapseShared 时，共享上游的网卡只保留 StandardSpeed 最高的一张
+func collapseShared(cards []CardSample) []CardSample {
+	if !GloNetCardConfig.CollapseShared() {
+		return cards
+	}
+	best := make(map[string]CardSample, len(cards))
+	for _, card := range cards {
+		best[card.IP] = card
+	}
+	var out []CardSample
+	for _, card := range cards {
+		_, others, _ := GloSharedUpstream.Info(card.IP)
+		keep := true
+		for _, other := range others {
+			o, ok := best[other]
+			if ok && (o.StandardSpeed > card.StandardSpeed || (o.StandardSpeed == card.StandardSpeed && other < card.IP)) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, card)
+		}
+	}
+	return out
+}
+
+// ========== 公网出口 ==========
+
+// egressIP 配置了回显URL时经网卡请求它，否则使用STUN
+func egressIP(ctx context.Context, IP string) (string, error) {
+	NetworkTester.mu.RLock()
+	config := NetworkTester.config
+	NetworkTester.mu.RUnlock()
+	if config.EgressEchoURL != "" {
+		return echoIP(ctx, IP, config.EgressEchoURL)
+	}
+	return stunIP(ctx, IP, config.STUNServer)
+}
+
+func echoIP(ctx context.Context, IP string, echoURL string) (string, error) {
+	client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, STUNTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, echoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	publicIP := net.ParseIP(strings.TrimSpace(string(body)))
+	if publicIP == nil {
+		return "", fmt.Errorf("echo %s returned %q", echoURL, body)
+	}
+	return publicIP.String(), nil
+}
+
+// stunIP 发送 STUN Binding 请求（RFC 5389），读取 XOR-MAPPED-ADDRESS
+func stunIP(ctx context.Context, IP string, server string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, STUNTimeout)
+	defer cancel()
+	dialer := &net.Dialer{LocalAddr: &net.UDPAddr{IP: net.ParseIP(IP)}, Control: BindControl(IP)}
+	conn, err := NICDialContext(IP, dialer)(ctx, "udp", server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	txID := req[8:20]
+	if _, err = rand.Read(txID); err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(req); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return parseSTUNResponse(buf[:n], txID)
+}
+
+func parseSTUNResponse(msg []byte, txID []byte) (string, error) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:]) != stunBindingResponse || string(msg[8:20]) != string(txID) {
+		return "", fmt.Errorf("unexpected stun response")
+	}
+	attrs := msg[20:]
+	if l := int(binary.BigEndian.Uint16(msg[2:])); l < len(attrs) {
+		attrs = attrs[:l]
+	}
+	var mapped string
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		length := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+length > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+length]
+		// 值：保留1字节、地址族1字节、端口2字节、地址
+		if len(value) >= 8 && (typ == stunXorMappedAddress || typ == stunMappedAddress) {
+			addr := make(net.IP, 0, 16)
+			switch value[1] {
+			case 0x01:
+				addr = append(addr, value[4:8]...)
+			case 0x02:
+				if len(value) >= 20 {
+					addr = append(addr, value[4:20]...)
+				}
+			}
+			if len(addr) > 0 {
+				if typ == stunXorMappedAddress {
+					// 地址与 magic cookie + 事务ID 异或
+					key := append(binary.BigEndian.AppendUint32(nil, stunMagicCookie), txID...)
+					for i := range addr {
+						addr[i] ^= key[i]
+					}
+					return addr.String(), nil
+				}
+				mapped = addr.String()
+			}
+		}
+		attrs = attrs[4+(length+3)/4*4:]
+	}
+	if mapped != "" {
+		return mapped, nil
+	}
+	return "", fmt.Errorf("no mapped address in stun response")
+}
+
+// ========== 相关性测速 ==========
+
+// correlatedTest 先逐个单独测速，再同时测速；同时测速的增益远小于独立链路应有的增益时判为共享
+// 有计费网卡（CostWeight>1）时不测速，测不出速度时同样返回 conclusive=false
+func correlatedTest(ctx context.Context, IPs []string) (shared bool, conclusive bool, evidence string) {
+	for _, IP := range IPs {
+		if GloNetCardConfig.CheckCard(IP).CostWeight > 1 {
+			return false, false, fmt.Sprintf("网卡<%s>按流量计费，不做相关性测速", IP)
+		}
+	}
+	solo := make([]float64, len(IPs))
+	var soloSum, soloMax float64
+	for i, IP := range IPs {
+		solo[i] = measureThroughput(ctx, []string{IP})[IP]
+		soloSum += solo[i]
+		soloMax = max(soloMax, solo[i])
+	}
+	together := 0.0
+	for _, v := range measureThroughput(ctx, IPs) {
+		together += v
+	}
+	evidence = fmt.Sprintf("单独 %v MB/s, 同时 %.2f MB/s", roundSpeeds(solo), together)
+	if soloMax == 0 || soloSum == soloMax {
+		return false, false, evidence + "（测速无效）"
+	}
+	return together < soloMax+SharedGainThreshold*(soloSum-soloMax), true, evidence
+}
+
+func roundSpeeds(speeds []float64) []string {
+	out := make([]string, len(speeds))
+	for i, v := range speeds {
+		out[i] = fmt.Sprintf("%.2f", v)
+	}
+	return out
+}
+
+// measureThroughput 经各网卡同时下载 SpeedTestURL，持续 CorrelatedTestTime，返回各网卡 MB/s
+func measureThroughput(ctx context.Context, IPs []string) map[string]float64 {
+	NetworkTester.mu.RLock()
+	testURL := NetworkTester.config.SpeedTestURL
+	NetworkTester.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(ctx, CorrelatedTestTime)
+	defer cancel()
+	counts := make([]atomic.Int64, len(IPs))
+	var wg sync.WaitGroup
+	for i, IP := range IPs {
+		client, err := NetCardClient.Probe(IP)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, testURL, nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			buf := make([]byte, 256*1024)
+			for {
+				n, err := resp.Body.Read(buf)
+				counts[i].Add(int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	out := make(map[string]float64, len(IPs))
+	for i, IP := range IPs {
+		out[IP] = float64(counts[i].Load()) / CorrelatedTestTime.Seconds() / (1024 * 1024)
+	}
+	return out
+}
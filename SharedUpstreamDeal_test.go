@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseSTUNResponse(t *testing.T) {
+	txID := []byte("0123456789ab")
+	attr := func(typ uint16, value []byte) []byte {
+		b := binary.BigEndian.AppendUint16(nil, typ)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+		b = append(b, value...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	// 地址值：保留1字节、地址族1字节、端口2字节、地址
+	addrValue := func(IP net.IP, xor bool) []byte {
+		family, raw := byte(0x01), IP.To4()
+		if raw == nil {
+			family, raw = 0x02, IP.To16()
+		}
+		raw = append([]byte(nil), raw...)
+		if xor {
+			key := append(binary.BigEndian.AppendUint32(nil, stunMagicCookie), txID...)
+			for i := range raw {
+				raw[i] ^= key[i]
+			}
+		}
+		return append([]byte{0, family, 0x12, 0x34}, raw...)
+	}
+	message := func(typ uint16, id []byte, attrs ...[]byte) []byte {
+		var body []byte
+		for _, a := range attrs {
+			body = append(body, a...)
+		}
+		b := binary.BigEndian.AppendUint16(nil, typ)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+		b = binary.BigEndian.AppendUint32(b, stunMagicCookie)
+		b = append(b, id...)
+		return append(b, body...)
+	}
+	xorV4 := attr(stunXorMappedAddress, addrValue(net.ParseIP("203.0.113.7"), true))
+	xorV6 := attr(stunXorMappedAddress, addrValue(net.ParseIP("2001:db8::1"), true))
+	mapped := attr(stunMappedAddress, addrValue(net.ParseIP("198.51.100.2"), false))
+	unknown := attr(0x8022, []byte("netbouncer"))
+	truncated := xorV4[:len(xorV4)-2]
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want string
+		ok   bool
+	}{
+		{"xor v4", message(stunBindingResponse, txID, xorV4), "203.0.113.7", true},
+		{"xor v6", message(stunBindingResponse, txID, xorV6), "2001:db8::1", true},
+		{"mapped", message(stunBindingResponse, txID, mapped), "198.51.100.2", true},
+		{"xor preferred", message(stunBindingResponse, txID, mapped, xorV4), "203.0.113.7", true},
+		{"skip unknown", message(stunBindingResponse, txID, unknown, xorV4), "203.0.113.7", true},
+		{"truncated attr", message(stunBindingResponse, txID, truncated), "", false},
+		{"truncated after mapped", message(stunBindingResponse, txID, mapped, truncated), "198.51.100.2", true},
+		{"short v6", message(stunBindingResponse, txID, attr(stunXorMappedAddress, addrValue(net.ParseIP("2001:db8::1"), true)[:12])), "", false},
+		{"no attrs", message(stunBindingResponse, txID), "", false},
+		{"wrong type", message(0x0111, txID, xorV4), "", false},
+		{"wrong txid", message(stunBindingResponse, []byte("ba9876543210"), xorV4), "", false},
+		{"short header", message(stunBindingResponse, txID)[:19], "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseSTUNResponse(tt.msg, txID)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%s: parseSTUNResponse = %q, %v; want %q ok=%v", tt.name, got, err, tt.want, tt.ok)
+		}
+	}
+}
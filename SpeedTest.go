@@ -29,6 +29,9 @@ type TestConfig struct {
 
 	// SpeedTest配置
 	SpeedTestURL      string
+	HealthCheckURL    string // 健康检查地址，需返回204
+	EgressEchoURL     string // 返回请求方公网IP的地址，为空时使用 STUNServer
+	STUNServer        string
 	SpeedTestDuration time.Duration
 	WarmTestDuration  time.Duration
 
@@ -38,7 +41,7 @@ type TestConfig struct {
 }
 
 type NetCardInfoPara struct {
-	Name       string
+	NetCardMeta
 	IP         string
 	MultiSpeed float64
 	TCPPingMs  int64
@@ -63,6 +66,8 @@ func (p *NetHTTPTest) DefaultTestConfig() {
 		TCPPingTimeout:    5 * time.Second,
 		TCPPingAttempts:   5,
 		SpeedTestURL:      "https://wirelesscdn-download.xuexi.cn/publish/xuexi_android/latest/xuexi_android_10002068.apk",
+		HealthCheckURL:    "http://connect.rom.miui.com/generate_204",
+		STUNServer:        "stun.miwifi.com:3478",
 		SpeedTestDuration: 3 * time.Second,
 		WarmTestDuration:  3 * time.Second,
 		SingleCurrency:    1,
@@ -87,18 +92,47 @@ func (p *NetHTTPTest) TCPSpeedTest() {
 	for _, InfoAd := range Infos { // 字典获取的不是对应值而是副本
 		InfoAd.TCPPingMs = p.TCPLink(InfoAd.IP, p.config.TCPPingHost)
 		fmt.Printf("对应IP<%s>To<%s>延迟: %d\n", InfoAd.IP, p.config.TCPPingHost, InfoAd.TCPPingMs)
+		if InfoAd.TCPPingMs < 0 {
+			GloNICHealth.activeResult(InfoAd.IP, fmt.Errorf("tcp ping %s failed", p.config.TCPPingHost))
+		}
 		bag := p.SpeedTest(InfoAd.IP)
 		InfoAd.MultiSpeed = bag.StandardSP
 		BestChunkSizeRecorder.content[InfoAd.IP] = bag.BestChunkSize
-		NetCardInfo.mu.Lock()
-		NetCardInfo.Content[InfoAd.IP].LowAvgSpeed = bag.LowAvgSpeed
-		NetCardInfo.Content[InfoAd.IP].FastestSpeed = bag.FastestSP
-		NetCardInfo.Content[InfoAd.IP].StandardSpeed = bag.StandardSP
-		NetCardInfo.mu.Unlock()
+		applySpeedTest(InfoAd.IP, bag)
 		fmt.Printf("对应IP<%s>To<%s>获取速率: %v\n", InfoAd.IP, p.config.SpeedTestURL, InfoAd.MultiSpeed)
 	}
 	return
 }
+
+// SpeedTestCard 对运行中新加入的单张网卡测速，测试期间不占用全局锁
+func (p *NetHTTPTest) SpeedTestCard(IP string) {
+	ping := p.TCPLink(IP, p.config.TCPPingHost)
+	bag := p.SpeedTest(IP)
+	p.mu.Lock()
+	if InfoAd, ok := p.NetCardInfo[IP]; ok {
+		InfoAd.TCPPingMs = ping
+		InfoAd.MultiSpeed = bag.StandardSP
+	}
+	p.mu.Unlock()
+	if bag.BestChunkSize > 0 {
+		BestChunkSizeRecorder.mu.Lock()
+		BestChunkSizeRecorder.content[IP] = bag.BestChunkSize
+		BestChunkSizeRecorder.mu.Unlock()
+	}
+	applySpeedTest(IP, bag)
+	fmt.Printf("新网卡<%s>延迟: %d, 获取速率: %v\n", IP, ping, bag.StandardSP)
+}
+
+// applySpeedTest 将测速结果写入网卡信息（网卡可能已被移除）
+func applySpeedTest(IP string, bag TestOutput) {
+	NetCardInfo.mu.Lock()
+	defer NetCardInfo.mu.Unlock()
+	if Info, ok := NetCardInfo.Content[IP]; ok {
+		Info.LowAvgSpeed = bag.LowAvgSpeed
+		Info.FastestSpeed = bag.FastestSP
+		Info.StandardSpeed = bag.StandardSP
+	}
+}
 func (p *NetHTTPInfo) InitBestProbeClient() string {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -120,11 +154,13 @@ func (p *NetHTTPTest) TCPLink(ip string, host string) int64 {
 	dialer := &net.Dialer{
 		LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)},
 		Timeout:   p.config.TCPPingTimeout,
+		Control:   BindControl(ip),
 	}
+	dial := NICDialContext(ip, dialer)
 	var RecordTimeSum int64 = 0
 	for _ = range p.config.TCPPingAttempts {
 		startTime := time.Now()
-		conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", host, p.config.TCPPingPort))
+		conn, err := dial(context.Background(), "tcp", net.JoinHostPort(host, fmt.Sprint(p.config.TCPPingPort)))
 		elapsedTime := time.Since(startTime)
 		if err != nil {
 			fmt.Printf("出现错误: %v\n", err)
@@ -139,9 +175,11 @@ func (p *NetHTTPTest) TCPLink(ip string, host string) int64 {
 }
 func (p *NetHTTPTest) SpeedTest(IP string) (outputBag TestOutput) {
 	// 获取客户端
-	NetCardClient.mu.RLock()
-	Client := NetCardClient.Content[IP].ProbeClient
-	NetCardClient.mu.RUnlock()
+	Client, err := NetCardClient.Probe(IP)
+	if err != nil {
+		fmt.Printf("网卡<%s>不可用: %v\n", IP, err)
+		return
+	}
 
 	// 进行有关测试
 	// 时间性byte/time记录
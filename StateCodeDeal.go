@@ -5,14 +5,58 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/textproto"
 	"strconv"
+	"strings"
 )
 
-func Hijack(w http.ResponseWriter, ContentLength int64) (conn net.Conn, bufrw *bufio.ReadWriter, err error) {
+// hopHeaders 逐跳头部以及由代理重新计算的长度/范围头部，写回客户端时需要去掉
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+	"Content-Range",
+}
+
+// AccelRespHeader 以源站响应头为基础构建加速响应头：保留文件名、类型、校验值、Cookie等，
+// 只去掉逐跳头部，并使用 Content-Length 定长传输（不再和 chunked 混用）
+func AccelRespHeader(origin http.Header, ContentLength int64) http.Header {
+	h := origin.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	// Connection 中列出的头部同样是逐跳的
+	for _, v := range origin.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if token = textproto.TrimString(token); token != "" {
+				h.Del(token)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	h.Set("Content-Length", strconv.FormatInt(ContentLength, 10))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Connection", "close")
+	h.Set("X-Proxy-Chunked", "true")
+	return h
+}
+
+func Hijack(w http.ResponseWriter, Header http.Header, ContentLength int64) (conn net.Conn, bufrw *bufio.ReadWriter, err error) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
+		return nil, nil, fmt.Errorf("hijacking not supported")
 	}
 	conn, bufrw, err = hj.Hijack()
 	if err != nil {
@@ -20,13 +64,7 @@ func Hijack(w http.ResponseWriter, ContentLength int64) (conn net.Conn, bufrw *b
 		return
 	}
 	bufrw.WriteString("HTTP/1.1 200 OK\r\n")
-	bufrw.WriteString("Content-Type: application/octet-stream\r\n")
-	bufrw.WriteString("Transfer-Encoding: chunked\r\n")
-	bufrw.WriteString("Accept-Ranges: bytes\r\n")
-	bufrw.WriteString("Connection: close\r\n") // 建议添加
-	bufrw.WriteString("Cache-Control: no-cache\r\n")
-	bufrw.WriteString("X-Proxy-Chunked: true\r\n")
-	bufrw.WriteString("Content-Length: " + strconv.FormatInt(ContentLength, 10) + "\r\n") // 这个如果后面有问题就会去掉
+	AccelRespHeader(Header, ContentLength).Write(bufrw)
 	bufrw.WriteString("\r\n")
 
 	// 刷新，Header 立即发送
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 分时规则：按星期与时段启用/停用/调整网卡权重（网卡配置 Schedule），按Host开关分块加速或调整各网卡权重（策略规则 Schedule）
+// 网卡规则在 PeriodCheck 发布快照时生效，切换最迟一个 CheckInterval 后体现在 NetCardCho 快照中；
+// 已经规划好的分块继续在原网卡上完成，只有之后规划的分块按新权重分配
+// Host规则在建立连接（是否加速）与规划分块（网卡权重）时生效，已有连接不受影响
+
+const (
+	ScheduleEnable  = "enable"  // 启用网卡，按原权重参与调度
+	ScheduleDisable = "disable" // 停用网卡，不再分配新的分块
+	ScheduleWeight  = "weight"  // 按 Weight 缩放网卡权重
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// TimeWindow 一个时段：Days 为空表示每天；End 早于 Start 时跨过午夜，算作 Start 所在那天的时段；Start 与 End 相同表示全天
+type TimeWindow struct {
+	Days  []string `json:"Days"`  // "Mon" ... "Sun"
+	Start string   `json:"Start"` // "HH:MM"
+	End   string   `json:"End"`   // "HH:MM"
+}
+
+// NICScheduleRule 网卡的分时规则，按顺序匹配第一条
+type NICScheduleRule struct {
+	TimeWindow
+	Action string  `json:"Action"` // enable / disable / weight
+	Weight float64 `json:"Weight"` // Action 为 weight 时的权重倍数，0 等同于 disable
+}
+
+// HostScheduleRule Host的分时规则，按顺序匹配第一条
+type HostScheduleRule struct {
+	TimeWindow
+	Accelerate *bool              `json:"Accelerate"` // 该时段是否分块加速，不设置时沿用策略
+	NICs       map[string]float64 `json:"NICs"`       // 网卡IP或网卡名 -> 权重倍数，0 为不使用该网卡，未列出的为1
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate 检查时段格式，加载配置时调用
+func (w TimeWindow) Validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	for _, d := range w.Days {
+		if _, ok := weekdayNames[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid day %q, want Mon..Sun", d)
+		}
+	}
+	return nil
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdayNames[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains now 是否落在时段内，格式错误的时段不匹配
+func (w TimeWindow) Contains(now time.Time) bool {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := now.AddDate(0, 0, -1).Weekday()
+	switch {
+	case start == end:
+		return w.onDay(today)
+	case start < end:
+		return minute >= start && minute < end && w.onDay(today)
+	default:
+		// 跨午夜：今天 Start 之后，或昨天开始的时段延续到今天 End 之前
+		return (minute >= start && w.onDay(today)) || (minute < end && w.onDay(yesterday))
+	}
+}
+
+// Factor 规则对应的权重倍数，0 为停用
+func (r NICScheduleRule) Factor() float64 {
+	switch r.Action {
+	case ScheduleDisable:
+		return 0
+	case ScheduleWeight:
+		return max(r.Weight, 0)
+	}
+	return 1
+}
+
+// ========== 网卡分时规则 ==========
+
+type NICScheduleTracker struct {
+	mu   sync.Mutex
+	last map[string]float64 // 源地址 -> 上一周期的权重倍数，用于打印切换
+}
+
+var GloNICSchedule = &NICScheduleTracker{
+	last: make(map[string]float64),
+}
+
+// Factor 网卡当前的权重倍数，没有匹配的规则时为1
+func (t *NICScheduleTracker) Factor(IP string, now time.Time) float64 {
+	for _, rule := range GloNetCardConfig.CheckCard(IP).Schedule {
+		if rule.Contains(now) {
+			return rule.Factor()
+		}
+	}
+	return 1
+}
+
+// observe 记录本周期的权重倍数，发生切换时打印
+func (t *NICScheduleTracker) observe(IP string, factor float64) {
+	t.mu.Lock()
+	old, ok := t.last[IP]
+	t.last[IP] = factor
+	t.mu.Unlock()
+	if !ok {
+		old = 1
+	}
+	if old == factor {
+		return
+	}
+	switch {
+	case factor == 0:
+		fmt.Printf("🕒 网卡<%s>按分时规则停用\n", IP)
+	case old == 0:
+		fmt.Printf("🕒 网卡<%s>按分时规则启用，权重 x%.2f\n", IP, factor)
+	default:
+		fmt.Printf("🕒 网卡<%s>按分时规则调整权重 x%.2f -> x%.2f\n", IP, old, factor)
+	}
+}
+
+// Status 网卡当前的分时状态，供dashboard展示，为空表示没有生效的规则
+func (t *NICScheduleTracker) Status(IP string) string {
+	switch factor := t.Factor(IP, time.Now()); {
+	case factor == 0:
+		return "disabled"
+	case factor != 1:
+		return fmt.Sprintf("x%.2f", factor)
+	}
+	return ""
+}
+
+// scaleSample 按倍数缩放样本的各项速度
+func scaleSample(card CardSample, factor float64) CardSample {
+	card.StandardSpeed *= factor
+	card.NowSpeed *= factor
+	speeds := make([]float64, len(card.Speeds))
+	for i, v := range card.Speeds {
+		speeds[i] = v * factor
+	}
+	card.Speeds = speeds
+	return card
+}
+
+// applySchedules 剔除按分时规则停用的网卡，其余按权重倍数缩放；全部停用时保留原样本，避免所有请求无处可去
+// （要在某时段完全不加速，应在策略规则中设置 Accelerate）
+func applySchedules(cards []CardSample) []CardSample {
+	now := time.Now()
+	var out []CardSample
+	for _, card := range cards {
+		factor := GloNICSchedule.Factor(card.IP, now)
+		GloNICSchedule.observe(card.IP, factor)
+		if factor == 0 {
+			continue
+		}
+		if factor != 1 {
+			card = scaleSample(card, factor)
+		}
+		out = append(out, card)
+	}
+	if len(out) == 0 {
+		return cards
+	}
+	return out
+}
+
+// ========== Host分时规则 ==========
+
+// HostSchedule 当前生效的Host分时规则
+func (p *PolicyManager) HostSchedule(host string, now time.Time) (HostScheduleRule, bool) {
+	for _, rule := range p.CheckRule(host).Schedule {
+		if rule.Contains(now) {
+			return rule, true
+		}
+	}
+	return HostScheduleRule{}, false
+}
+
+// nicFactor 规则中网卡的权重倍数：IP优先，其次网卡名
+func (r HostScheduleRule) nicFactor(IP string) float64 {
+	if w, ok := r.NICs[IP]; ok {
+		return max(w, 0)
+	}
+	if w, ok := r.NICs[GloSiblings.Name(IP)]; ok {
+		return max(w, 0)
+	}
+	return 1
+}
+
+// weightedSnapshot 按Host分时规则调整快照中各网卡的选择概率；调整后没有可用网卡时使用原快照
+func weightedSnapshot(host string, snapshot *NetCardHTTPCho) *NetCardHTTPCho {
+	rule, ok := GlobalPolicyManager.HostSchedule(host, time.Now())
+	if !ok || len(rule.NICs) == 0 || snapshot == nil {
+		return snapshot
+	}
+	out := &NetCardHTTPCho{}
+	for _, Entry := range snapshot.ChunksEntries {
+		if w := rule.nicFactor(Entry.IP); w > 0 {
+			Entry.ProbNum *= w
+			out.ChunksEntries = append(out.ChunksEntries, Entry)
+			out.TotalChunks += Entry.ProbNum
+		}
+	}
+	for _, Entry := range snapshot.ProbeEntries {
+		if w := rule.nicFactor(Entry.IP); w > 0 {
+			Entry.ProbNum *= w
+			out.ProbeEntries = append(out.ProbeEntries, Entry)
+			out.TotalProbe += Entry.ProbNum
+		}
+	}
+	if len(out.ChunksEntries) == 0 {
+		return snapshot
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	// 2026-10-16 为周五
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name string
+		w    TimeWindow
+		now  time.Time
+		want bool
+	}{
+		{"inside", TimeWindow{Start: "09:00", End: "18:00"}, at(16, 12, 0), true},
+		{"start inclusive", TimeWindow{Start: "09:00", End: "18:00"}, at(16, 9, 0), true},
+		{"end exclusive", TimeWindow{Start: "09:00", End: "18:00"}, at(16, 18, 0), false},
+		{"before", TimeWindow{Start: "09:00", End: "18:00"}, at(16, 8, 59), false},
+		{"all day", TimeWindow{Start: "00:00", End: "00:00"}, at(16, 23, 59), true},
+		{"weekday match", TimeWindow{Days: []string{"Fri"}, Start: "09:00", End: "18:00"}, at(16, 10, 0), true},
+		{"weekday case", TimeWindow{Days: []string{"fri"}, Start: "09:00", End: "18:00"}, at(16, 10, 0), true},
+		{"weekday miss", TimeWindow{Days: []string{"Mon"}, Start: "09:00", End: "18:00"}, at(16, 10, 0), false},
+		{"all day weekday miss", TimeWindow{Days: []string{"Sat"}, Start: "00:00", End: "00:00"}, at(16, 10, 0), false},
+		// 跨午夜：周五 22:00 到周六 02:00 算作周五的时段
+		{"midnight evening", TimeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00"}, at(16, 23, 0), true},
+		{"midnight next morning", TimeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00"}, at(17, 1, 59), true},
+		{"midnight next morning end", TimeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00"}, at(17, 2, 0), false},
+		{"midnight same morning", TimeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00"}, at(16, 1, 0), false},
+		{"midnight next evening", TimeWindow{Days: []string{"Fri"}, Start: "22:00", End: "02:00"}, at(17, 23, 0), false},
+		{"midnight gap", TimeWindow{Start: "22:00", End: "02:00"}, at(16, 12, 0), false},
+		// 周日开始的时段延续到周一
+		{"week rollover", TimeWindow{Days: []string{"Sun"}, Start: "23:00", End: "01:00"}, at(19, 0, 30), true},
+		{"bad clock", TimeWindow{Start: "9:00pm", End: "18:00"}, at(16, 12, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.w.Contains(tt.now); got != tt.want {
+			t.Errorf("%s: Contains(%s) = %v, want %v", tt.name, tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestTimeWindowValidate(t *testing.T) {
+	tests := []struct {
+		w     TimeWindow
+		valid bool
+	}{
+		{TimeWindow{Start: "00:00", End: "23:59"}, true},
+		{TimeWindow{Days: []string{"Mon", "sun"}, Start: "22:00", End: "02:00"}, true},
+		{TimeWindow{Start: "24:00", End: "02:00"}, false},
+		{TimeWindow{Start: "08:00", End: ""}, false},
+		{TimeWindow{Days: []string{"Monday"}, Start: "08:00", End: "09:00"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.w.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, want valid=%v", tt.w, err, tt.valid)
+		}
+	}
+}
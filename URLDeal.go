@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // URLSave
@@ -27,6 +28,23 @@ var GloCodeCache = &GlobalCodeCache{
 	FilePath: "./Cache/URICode.json",
 }
 
+// GlobalNoRangeCache 记录返回过不合规分块响应的Host（值为记录时间戳），有效期内的请求不再对其分块
+// 服务器忽略Range记入 Cache 并保存到本地；CDN节点之间文件版本不一致只是暂时的，单独记入 Versions，不保存
+type GlobalNoRangeCache struct {
+	Cache    sync.Map
+	Versions sync.Map
+	FilePath string
+}
+
+const (
+	NoRangeTTL    = 24 * time.Hour   // 服务器忽略Range的标记有效期
+	NoRangeVerTTL = 10 * time.Minute // 文件版本不一致的标记有效期
+)
+
+var GloNoRangeCache = &GlobalNoRangeCache{
+	FilePath: "./Cache/NoRangeHost.json",
+}
+
 func (p *GlobalFileSizeCache) URLSizeLoad() error {
 	if _, err := os.Stat(p.FilePath); os.IsNotExist(err) {
 		fmt.Printf("⚠️ 缓存文件不存在: %s，使用空缓存\n", p.FilePath)
@@ -75,9 +93,36 @@ func (p *GlobalCodeCache) URLCodeLoad() error {
 	fmt.Printf("✅ 缓存FileSize已加载: %d 条记录\n", len(tmp))
 	return nil
 }
+func (p *GlobalNoRangeCache) NoRangeLoad() error {
+	if _, err := os.Stat(p.FilePath); os.IsNotExist(err) {
+		fmt.Printf("⚠️ 缓存文件不存在: %s，使用空缓存\n", p.FilePath)
+		return nil
+	}
+	data, err := os.ReadFile(p.FilePath)
+	if err != nil {
+		return fmt.Errorf("读取文件失败: %v", err)
+	}
+	tmp := make(map[string]int64)
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return fmt.Errorf("JSON 解析失败: %v", err)
+	}
+	// 过期的记录不再加载
+	expire := time.Now().Add(-NoRangeTTL).Unix()
+	loaded := 0
+	for k, v := range tmp {
+		if v < expire {
+			continue
+		}
+		p.Cache.Store(k, v)
+		loaded++
+	}
+	fmt.Printf("✅ 缓存NoRangeHost已加载: %d 条记录\n", loaded)
+	return nil
+}
 func URLLoad() {
 	GloFileSizeCache.URLSizeLoad()
 	GloCodeCache.URLCodeLoad()
+	GloNoRangeCache.NoRangeLoad()
 }
 
 func (p *GlobalFileSizeCache) URLFileSizeSaveLocal() {
@@ -133,9 +178,63 @@ func (p *GlobalCodeCache) URLCodeSaveLocal() {
 	}
 	fmt.Printf("缓存已经保存到本地目录\n")
 }
+func (p *GlobalNoRangeCache) NoRangeSaveLocal() {
+	tmp := make(map[string]int64)
+	p.Cache.Range(func(k, v any) bool {
+		ks, ok := k.(string)
+		if !ok {
+			return true
+		}
+		if vi, ok := v.(int64); ok {
+			tmp[ks] = vi
+		}
+		return true
+	})
+
+	dir := filepath.Dir(p.FilePath)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Printf("创建目录失败: %v", err)
+	}
+	data, err := json.MarshalIndent(tmp, "", "  ")
+	if err != nil {
+		fmt.Printf("序列化失败: %v\n", err)
+	}
+	if err := os.WriteFile(p.FilePath, data, 0o644); err != nil {
+		fmt.Printf("写入文件失败: %v\n", err)
+	}
+}
 func URLSaveLocal() {
 	GloCodeCache.URLCodeSaveLocal()
 	GloFileSizeCache.URLFileSizeSaveLocal()
+	GloNoRangeCache.NoRangeSaveLocal()
+}
+
+// MarkHost 将Host标记为不支持分块
+func (p *GlobalNoRangeCache) MarkHost(host string) {
+	p.Cache.Store(host, time.Now().Unix())
+}
+
+// MarkVersion 记录Host的分块响应文件版本与首个响应不一致，短时间内不再对其分块
+func (p *GlobalNoRangeCache) MarkVersion(host string) {
+	p.Versions.Store(host, time.Now().Unix())
+}
+
+// IsNoRange 判断Host是否在有效期内被标记为不支持分块，过期的记录顺便删除
+func (p *GlobalNoRangeCache) IsNoRange(host string) bool {
+	now := time.Now()
+	return p.valid(&p.Cache, host, now.Add(-NoRangeTTL)) || p.valid(&p.Versions, host, now.Add(-NoRangeVerTTL))
+}
+
+func (p *GlobalNoRangeCache) valid(m *sync.Map, host string, since time.Time) bool {
+	v, ok := m.Load(host)
+	if !ok {
+		return false
+	}
+	if at, _ := v.(int64); at >= since.Unix() {
+		return true
+	}
+	m.CompareAndDelete(host, v)
+	return false
 }
 
 // URLSave 存记录
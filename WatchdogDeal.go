@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StallTimeout      = 15 * time.Second // 分块连续无进展超过该时间即判定卡死
+	SlowGrace         = 5 * time.Second  // 开始判定慢速之前的预热时间
+	SlowRatio         = 0.1              // 低于网卡单连接期望速率的比例即判定过慢
+	WatchInterval     = 1 * time.Second
+	ClientIdleTimeout = 30 * time.Second // 上游Body读取的空闲超时（非总时长）
+	ServerWriteIdle   = 60 * time.Second // 写回客户端的空闲超时（非总时长）
+)
+
+// ========== 1. 传输进度记录 ==========
+
+// TransferProgress 记录单个分块传输的进度，供看门狗判断卡死/过慢
+type TransferProgress struct {
+	Index    int
+	IP       string
+	Start    time.Time
+	bytes    atomic.Int64
+	lastNano atomic.Int64
+	cancel   context.CancelCauseFunc
+}
+
+func (t *TransferProgress) Add(n int) {
+	if n <= 0 {
+		return
+	}
+	t.bytes.Add(int64(n))
+	t.lastNano.Store(time.Now().UnixNano())
+}
+func (t *TransferProgress) Bytes() int64 {
+	return t.bytes.Load()
+}
+func (t *TransferProgress) IdleFor() time.Duration {
+	return time.Since(time.Unix(0, t.lastNano.Load()))
+}
+
+type ProgressReader struct {
+	Reader   io.Reader
+	Progress *TransferProgress
+}
+
+func (p *ProgressReader) Read(b []byte) (n int, err error) {
+	n, err = p.Reader.Read(b)
+	p.Progress.Add(n)
+	return n, err
+}
+
+// ========== 2. 分块看门狗 ==========
+
+// ChunkWatchdog 监控一次分块下载中所有进行中的分块，卡死或远低于网卡期望速率的分块会被取消并改派
+type ChunkWatchdog struct {
+	mu     sync.Mutex
+	active map[int]*TransferProgress
+}
+
+func NewChunkWatchdog() *ChunkWatchdog {
+	return &ChunkWatchdog{active: make(map[int]*TransferProgress)}
+}
+
+// Track 为分块创建可单独取消的ctx并登记进度，done 必须在分块结束时调用
+func (w *ChunkWatchdog) Track(parent context.Context, task ChunkTask) (ctx context.Context, progress *TransferProgress, done func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	now := time.Now()
+	progress = &TransferProgress{
+		Index:  task.Index,
+		IP:     task.ClientIP,
+		Start:  now,
+		cancel: cancel,
+	}
+	progress.lastNano.Store(now.UnixNano())
+	w.mu.Lock()
+	w.active[task.Index] = progress
+	w.mu.Unlock()
+	done = func() {
+		w.mu.Lock()
+		if w.active[task.Index] == progress {
+			delete(w.active, task.Index)
+		}
+		w.mu.Unlock()
+		cancel(nil)
+	}
+	return ctx, progress, done
+}
+
+// Run 周期检查，直到ctx结束
+func (w *ChunkWatchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+func (w *ChunkWatchdog) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for index, progress := range w.active {
+		if idle := progress.IdleFor(); idle > StallTimeout {
+			progress.cancel(fmt.Errorf("retryable: chunk %d stalled for %v on %s", index, idle.Round(time.Second), progress.IP))
+			delete(w.active, index)
+			continue
+		}
+		elapsed := time.Since(progress.Start)
+		if elapsed < SlowGrace {
+			continue
+		}
+		expected := expectedClientRate(progress.IP)
+		rate := float64(progress.Bytes()) / elapsed.Seconds()
+		if expected > 0 && rate < expected*SlowRatio {
+			progress.cancel(fmt.Errorf("retryable: chunk %d too slow on %s (%.2f MB/s, expected %.2f MB/s)",
+				index, progress.IP, rate/(1024*1024), expected/(1024*1024)))
+			delete(w.active, index)
+		}
+	}
+}
+
+// expectedClientRate 网卡单条连接的期望速率 (B/s)，由 PeriodCheck 维护的 StandardSpeed 平均到各连接
+func expectedClientRate(IP string) float64 {
+	NetCardInfo.mu.RLock()
+	defer NetCardInfo.mu.RUnlock()
+	info, ok := NetCardInfo.Content[IP]
+	if !ok || len(info.EachClient) == 0 {
+		return 0
+	}
+	return info.StandardSpeed * 1024 * 1024 / float64(len(info.EachClient))
+}
+
+// chunkErr 统一分块错误：被看门狗取消时返回其原因，分块不合规原样返回，其余传输错误标记为可重试
+func chunkErr(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, ErrChunkMismatch) {
+		return err
+	}
+	if cause := context.Cause(ctx); cause != nil && ctx.Err() != nil {
+		return cause
+	}
+	if taskRetryable(err) {
+		return err
+	}
+	return fmt.Errorf("retryable: %w", err)
+}
+
+// ========== 3. 空闲超时（替代绝对超时） ==========
+
+// IdleTimeoutTransport 给上游响应Body加上空闲超时：只要数据在流动就不会超时
+type IdleTimeoutTransport struct {
+	Base http.RoundTripper
+	Idle time.Duration
+}
+
+func (t *IdleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = newIdleBody(resp.Body, t.Idle)
+	return resp, nil
+}
+
+// CloseIdleConnections 转交给底层Transport，使 http.Client.CloseIdleConnections 生效
+func (t *IdleTimeoutTransport) CloseIdleConnections() {
+	if c, ok := t.Base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type idleBody struct {
+	rc       io.ReadCloser
+	idle     time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleBody(rc io.ReadCloser, idle time.Duration) *idleBody {
+	b := &idleBody{rc: rc, idle: idle}
+	b.timer = time.AfterFunc(idle, func() {
+		b.timedOut.Store(true)
+		rc.Close()
+	})
+	b.timer.Stop()
+	return b
+}
+
+// Read 只在等待上游数据期间计时，下游写入慢不会被误判为上游空闲
+func (b *idleBody) Read(p []byte) (n int, err error) {
+	b.timer.Reset(b.idle)
+	n, err = b.rc.Read(p)
+	b.timer.Stop()
+	if b.timedOut.Load() {
+		return n, fmt.Errorf("retryable: upstream idle for %v", b.idle)
+	}
+	return n, err
+}
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	return b.rc.Close()
+}
+
+// idleWriteConn 每次写入前刷新写超时，慢速但持续的大文件传输不会被截断
+type idleWriteConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+func (c *idleWriteConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.idle))
+	return c.Conn.Write(p)
+}
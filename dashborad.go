@@ -22,6 +22,10 @@ type UIDataPacket struct {
 	Running   bool         `json:"running"`
 	Timestamp int64        `json:"timestamp"`
 	Cards     []UICardInfo `json:"cards"`
+	// 配置方案
+	Profile       string   `json:"profile"`
+	Profiles      []string `json:"profiles"`
+	ProfilePinned bool     `json:"profile_pinned"`
 }
 
 type UICardInfo struct {
@@ -29,9 +33,22 @@ type UICardInfo struct {
 	StandardSpeed float64 `json:"standard_speed"`
 	NowSpeed      float64 `json:"now_speed"`
 	// 每个客户端的实时速度
-	ProbeSpeed  float64 `json:"probe_speed"`
-	Chunk0Speed float64 `json:"chunk0_speed"`
-	Chunk1Speed float64 `json:"chunk1_speed"`
+	ProbeSpeed  float64   `json:"probe_speed"`
+	ChunkSpeeds []float64 `json:"chunk_speeds"`
+	// 健康状态
+	Health       string `json:"health"`
+	HealthReason string `json:"health_reason"`
+	PortalURL    string `json:"portal_url"` // 被认证页面拦截时的登录地址
+	// 共享上游
+	PublicIP     string   `json:"public_ip"`
+	SharedWith   []string `json:"shared_with"`
+	SharedReason string   `json:"shared_reason"`
+	// 网卡元数据
+	Meta NetCardMeta `json:"meta"`
+	// 计费与配额
+	Quota QuotaStatus `json:"quota"`
+	// 分时规则："disabled"、"x0.50" 等，为空表示没有生效的规则
+	Schedule string `json:"schedule"`
 }
 
 // --- 2. WebSocket 管理器 ---
@@ -57,6 +74,7 @@ func StartDashboard(port int, cancel context.CancelFunc) {
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", serveWs)
 	http.HandleFunc("/api/control", handleControl) // 控制开始/停止
+	http.HandleFunc("/api/profile", handleProfile) // 切换配置方案
 
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
 	fmt.Printf("Dashboard started at http://%s\n", addr)
@@ -90,11 +108,15 @@ func handleMessages() {
 // 推送数据给前端的公开方法
 
 func BroadcastUpdate(cards []UICardInfo) {
+	profile, profiles, pinned := GloProfiles.Current()
 	packet := UIDataPacket{
-		Type:      "update",
-		Running:   IsSystemRunning,
-		Timestamp: time.Now().UnixMilli(),
-		Cards:     cards,
+		Type:          "update",
+		Running:       IsSystemRunning,
+		Timestamp:     time.Now().UnixMilli(),
+		Cards:         cards,
+		Profile:       profile,
+		Profiles:      profiles,
+		ProfilePinned: pinned,
 	}
 	// 非阻塞发送，防止前端卡死影响后端
 	select {
@@ -132,6 +154,17 @@ func handleControl(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleProfile 切换配置方案，name=auto 恢复自动选择；重新初始化网卡较慢，异步执行
+func handleProfile(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	go ProfileCommand([]string{name})
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func serveHome(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(htmlContent))
 }
@@ -188,7 +221,8 @@ const htmlContent = `
                     <span id="status-text">Running</span>
                 </div>
             </div>
-            <div>
+            <div class="d-flex align-items-center">
+                <select id="profile-select" class="form-select form-select-sm me-2" style="width: auto; display: none;" onchange="switchProfile(this.value)"></select>
                 <button class="btn btn-success me-2" onclick="controlSystem('start')">▶ Start</button>
                 <button class="btn btn-danger" onclick="controlSystem('stop')">⏹ Stop</button>
             </div>
@@ -212,6 +246,7 @@ const htmlContent = `
                 const data = JSON.parse(event.data);
                 if (data.type === 'update') {
                     updateStatus(data.running);
+                    updateProfiles(data.profile, data.profiles, data.profile_pinned);
                     updateDashboard(data.timestamp, data.cards);
                 }
             } catch (e) {
@@ -236,6 +271,34 @@ const htmlContent = `
             }
         }
 
+        function updateProfiles(current, profiles, pinned) {
+            var select = document.getElementById('profile-select');
+            if (!profiles || profiles.length === 0) {
+                select.style.display = 'none';
+                return;
+            }
+            select.style.display = '';
+            var options = ['auto'].concat(profiles);
+            if (select.dataset.names !== options.join(',')) {
+                select.dataset.names = options.join(',');
+                select.innerHTML = '';
+                options.forEach(function(name) {
+                    var opt = document.createElement('option');
+                    opt.value = name;
+                    select.appendChild(opt);
+                });
+            }
+            select.options[0].text = 'Auto' + (pinned ? '' : ' (' + (current || '-') + ')');
+            for (var i = 1; i < select.options.length; i++) select.options[i].text = 'Profile: ' + select.options[i].value;
+            if (document.activeElement !== select) select.value = pinned ? current : 'auto';
+        }
+
+        function switchProfile(name) {
+            fetch('/api/profile?name=' + encodeURIComponent(name))
+                .then(response => console.log("Profile switch sent:", name))
+                .catch(error => console.error("Profile error:", error));
+        }
+
         function controlSystem(action) {
             fetch('/api/control?action=' + action)
                 .then(response => console.log("Control action sent:", action))
@@ -263,6 +326,56 @@ const htmlContent = `
                 var nowElem = document.getElementById('now-' + card.ip);
                 if (stdElem) stdElem.innerText = card.standard_speed.toFixed(2) + ' MB/s';
                 if (nowElem) nowElem.innerText = card.now_speed.toFixed(2) + ' MB/s';
+                var metaElem = document.getElementById('meta-' + card.ip);
+                if (metaElem && card.meta) {
+                    var m = card.meta;
+                    metaElem.innerText = [m.name, m.kind, m.mac, m.mtu ? 'MTU ' + m.mtu : '', m.gateway ? 'GW ' + m.gateway : '', (m.addrs || []).join(' ')]
+                        .filter(function(v) { return v; }).join(' · ');
+                }
+                var quotaElem = document.getElementById('quota-' + card.ip);
+                if (quotaElem && card.quota) {
+                    var q = card.quota;
+                    var parts = [];
+                    if (q.cost_weight > 1) parts.push('Metered x' + q.cost_weight);
+                    if (q.remaining >= 0) parts.push((q.remaining / 1073741824).toFixed(2) + ' GB left');
+                    quotaElem.style.display = parts.length ? '' : 'none';
+                    quotaElem.innerText = q.exhausted ? 'Quota exhausted' : parts.join(' · ');
+                    quotaElem.style.color = q.exhausted ? '#ff4444' : '#ffff00';
+                    quotaElem.style.borderColor = q.exhausted ? '#ff4444' : '#ffff00';
+                    quotaElem.title = 'Today: ' + (q.day_bytes / 1048576).toFixed(1) + ' MB' + (q.daily_quota > 0 ? ' / ' + (q.daily_quota / 1048576).toFixed(0) + ' MB' : '') +
+                        '\nCycle: ' + (q.cycle_bytes / 1048576).toFixed(1) + ' MB' + (q.monthly_quota > 0 ? ' / ' + (q.monthly_quota / 1048576).toFixed(0) + ' MB' : '');
+                }
+                var schedElem = document.getElementById('sched-' + card.ip);
+                if (schedElem) {
+                    schedElem.style.display = card.schedule ? '' : 'none';
+                    schedElem.innerText = card.schedule === 'disabled' ? 'Scheduled off' : 'Scheduled ' + card.schedule;
+                }
+                var sharedElem = document.getElementById('shared-' + card.ip);
+                if (sharedElem) {
+                    var shared = card.shared_with && card.shared_with.length > 0;
+                    sharedElem.style.display = shared ? '' : 'none';
+                    sharedElem.innerText = shared ? 'Shared: ' + card.shared_with.join(', ') : '';
+                    sharedElem.title = (card.public_ip ? 'Public IP: ' + card.public_ip + '\n' : '') + (card.shared_reason || '');
+                }
+                var healthElem = document.getElementById('health-' + card.ip);
+                if (healthElem) {
+                    var color = { healthy: '#00ff00', unhealthy: '#ff4444', portal: '#ffaa00' }[card.health] || '#00ff00';
+                    healthElem.title = card.health_reason || '';
+                    healthElem.style.color = color;
+                    healthElem.style.borderColor = color;
+                    if (card.health === 'portal' && /^https?:\/\//i.test(card.portal_url || '')) {
+                        // 登录请求经代理发出时会自动走被拦截的网卡
+                        healthElem.innerHTML = '';
+                        var link = document.createElement('a');
+                        link.href = card.portal_url;
+                        link.target = '_blank';
+                        link.style.color = color;
+                        link.innerText = 'Portal: Login';
+                        healthElem.appendChild(link);
+                    } else {
+                        healthElem.innerText = { unhealthy: 'Unhealthy', portal: 'Portal' }[card.health] || 'Healthy';
+                    }
+                }
 
                 // 更新图表
                 if (charts[card.ip]) {
@@ -271,26 +384,19 @@ const htmlContent = `
                     
                     // 构造数据点：[时间戳, 数值]
                     // ECharts time 轴会自动处理时间戳
-                    const newStd = { name: timestamp, value: [timestamp, card.standard_speed] };
-                    const newProbe = { name: timestamp, value: [timestamp, card.probe_speed] };
-                    const newChunk0 = { name: timestamp, value: [timestamp, card.chunk0_speed] };
-                    const newChunk1 = { name: timestamp, value: [timestamp, card.chunk1_speed] };
+                    const values = [card.standard_speed, card.probe_speed].concat(card.chunk_speeds || []);
 
-                    // 添加新数据
-                    option.series[0].data.push(newStd);
-                    option.series[1].data.push(newProbe);
-                    option.series[2].data.push(newChunk0);
-                    option.series[3].data.push(newChunk1);
+                    // 添加新数据（Capacity、Probe、各分块连接）
+                    option.series.forEach(function(series, i) {
+                        series.data.push({ name: timestamp, value: [timestamp, values[i] || 0] });
+                    });
 
                     // 清理旧数据 (早于 minTime 的)
                     // 只需检查 series[0]，其他同步清理
                     while (option.series[0].data.length > 0) {
                         // data[0].value[0] 是 X 轴的时间戳
                         if (option.series[0].data[0].value[0] < minTime) {
-                            option.series[0].data.shift();
-                            option.series[1].data.shift();
-                            option.series[2].data.shift();
-                            option.series[3].data.shift();
+                            option.series.forEach(function(series) { series.data.shift(); });
                         } else {
                             break;
                         }
@@ -312,21 +418,34 @@ const htmlContent = `
                     '<div class="card-header">' +
                         '<span>📡 NIC: ' + card.ip + '</span>' +
                         '<div>' +
+                            '<span class="speed-badge" id="sched-' + card.ip + '" style="border: 1px solid #00bfff; color: #00bfff; display: none;"></span>' +
+                            '<span class="speed-badge" id="quota-' + card.ip + '" style="border: 1px solid #ffff00; color: #ffff00; display: none;"></span>' +
+                            '<span class="speed-badge" id="shared-' + card.ip + '" style="border: 1px solid #ffaa00; color: #ffaa00; display: none;"></span>' +
+                            '<span class="speed-badge" id="health-' + card.ip + '" style="border: 1px solid #00ff00; color: #00ff00;">Healthy</span>' +
                             '<span class="speed-badge" style="border: 1px solid #808080; color: #a0a0a0;">Std: <span id="std-' + card.ip + '">0</span></span>' +
                             '<span class="speed-badge" style="border: 1px solid #00ff00; color: #00ff00;">Now: <span id="now-' + card.ip + '">0</span></span>' +
                         '</div>' +
                     '</div>' +
                     '<div class="card-body">' +
+                        '<div id="meta-' + card.ip + '" style="color: #808080; font-size: 0.85em; margin-bottom: 5px;"></div>' +
                         '<div id="chart-' + card.ip + '" class="chart-container"></div>' +
                     '</div>' +
                 '</div>' +
             '</div>';
             
             container.insertAdjacentHTML('beforeend', html);
-            initChart(card.ip);
+            initChart(card.ip, (card.chunk_speeds || []).length);
         }
 
-        function initChart(ip) {
+        const chunkColors = ['#00ccff', '#ffff00', '#ff8800', '#00ff88', '#ff4444', '#aa88ff'];
+
+        function initChart(ip, chunkNum) {
+            const chunkSeries = [];
+            const legend = ['Capacity', 'Probe'];
+            for (let i = 0; i < chunkNum; i++) {
+                legend.push('Chunk ' + i);
+                chunkSeries.push({ name: 'Chunk ' + i, type: 'line', smooth: true, showSymbol: false, data: [], lineStyle: { width: 2, color: chunkColors[i % chunkColors.length] } });
+            }
             const chartDom = document.getElementById('chart-' + ip);
             const myChart = echarts.init(chartDom, 'dark', {renderer: 'canvas'});
             
@@ -345,7 +464,7 @@ const htmlContent = `
                         return html;
                     }
                 },
-                legend: { data: ['Capacity', 'Probe', 'Chunk 0', 'Chunk 1'], bottom: 0 },
+                legend: { data: legend, bottom: 0 },
                 grid: { top: 30, left: 50, right: 20, bottom: 40 },
                 // 【关键】X 轴改为时间类型
                 xAxis: { 
@@ -369,10 +488,8 @@ const htmlContent = `
                         areaStyle: { opacity: 0.1, color: '#808080' },
                         z: 1 
                     },
-                    { name: 'Probe', type: 'line', smooth: true, showSymbol: false, data: [], lineStyle: { width: 2, color: '#ff00ff' } },
-                    { name: 'Chunk 0', type: 'line', smooth: true, showSymbol: false, data: [], lineStyle: { width: 2, color: '#00ccff' } },
-                    { name: 'Chunk 1', type: 'line', smooth: true, showSymbol: false, data: [], lineStyle: { width: 2, color: '#ffff00' } }
-                ],
+                    { name: 'Probe', type: 'line', smooth: true, showSymbol: false, data: [], lineStyle: { width: 2, color: '#ff00ff' } }
+                ].concat(chunkSeries),
                 animation: false // 关闭动画以减少 CPU 消耗，平滑滚动
             };
             myChart.setOption(option);